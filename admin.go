@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// connInfo describes one connection in the /admin/connections listing.
+type connInfo struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Stats      ConnStats `json:"stats"`
+}
+
+// adminOnly guards an admin endpoint with AdminAuthenticate. The endpoints
+// can disconnect clients, so without it they are disabled rather than left
+// open.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminAuthenticate == nil {
+			http.Error(w, "admin endpoints need an authenticator", http.StatusForbidden)
+			return
+		}
+		if _, err := s.AdminAuthenticate(r); err != nil {
+			s.logger().Warn("admin authentication failed", "event", "auth",
+				"remote_addr", r.RemoteAddr, "err", err)
+			s.Metrics.error("auth")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminConnections lists every open connection, oldest first.
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	infos := make([]connInfo, 0, len(s.conns))
+	for c := range s.conns {
+		infos = append(infos, connInfo{
+			ID:         c.id,
+			UserID:     c.userID,
+			RemoteAddr: c.remoteAddr,
+			Stats:      c.Stats(),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Stats.ConnectedAt.Before(infos[j].Stats.ConnectedAt)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// handleAdminKick closes the connection named by the id query parameter
+// with CloseNormalClosure. A connection that is already going away is
+// closed at most once, since closing goes through its writer.
+func (s *Server) handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	c := s.lookup(id)
+	if c == nil {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	c.log.Info("connection kicked", "event", "kick", "admin_addr", r.RemoteAddr)
+	c.close(websocket.CloseNormalClosure, "kicked by operator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookup returns the open connection with the given ID, or nil.
+func (s *Server) lookup(id string) *Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
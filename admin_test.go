@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"Websocket/testutil"
+	"github.com/gorilla/websocket"
+)
+
+// startAdmin serves s like main does, with the admin endpoints next to the
+// WebSocket endpoint.
+func startAdmin(t *testing.T, s *Server) *testutil.Harness {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/ws", s.HTTPHandler())
+	mux.HandleFunc("/admin/connections", s.adminOnly(s.handleAdminConnections))
+	mux.HandleFunc("/admin/kick", s.adminOnly(s.handleAdminKick))
+	h := testutil.Start(t, mux)
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return h
+}
+
+// adminRequest sends an admin request with token as the bearer token.
+func adminRequest(t *testing.T, h *testutil.Harness, method, path, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, h.Server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func tokenAuth(token, userID string) Authenticator {
+	return func(r *http.Request) (string, error) {
+		if RequestToken(r) != token {
+			return "", errors.New("bad token")
+		}
+		return userID, nil
+	}
+}
+
+func TestAdminListAndKick(t *testing.T) {
+	s := NewServer()
+	s.Authenticate = tokenAuth("user-token", "alice")
+	s.AdminAuthenticate = tokenAuth("admin-token", "ops")
+	h := startAdmin(t, s)
+	c := h.Dial("/ws?token=user-token")
+	waitForConns(t, s, 1)
+
+	resp := adminRequest(t, h, http.MethodGet, "/admin/connections", "admin-token")
+	var infos []connInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].UserID != "alice" || infos[0].RemoteAddr == "" {
+		t.Fatalf("listed %+v, want alice's connection", infos)
+	}
+
+	if resp := adminRequest(t, h, http.MethodGet, "/admin/kick?id="+infos[0].ID, "admin-token"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET kick returned %s, want 405", resp.Status)
+	}
+	if resp := adminRequest(t, h, http.MethodPost, "/admin/kick?id=nope", "admin-token"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("kicking an unknown connection returned %s, want 404", resp.Status)
+	}
+	if resp := adminRequest(t, h, http.MethodPost, "/admin/kick?id="+infos[0].ID, "admin-token"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick returned %s, want 204", resp.Status)
+	}
+	c.ExpectClose(websocket.CloseNormalClosure)
+}
+
+func TestAdminRejectsOrdinaryUsers(t *testing.T) {
+	s := NewServer()
+	s.Authenticate = tokenAuth("user-token", "alice")
+	s.AdminAuthenticate = tokenAuth("admin-token", "ops")
+	h := startAdmin(t, s)
+
+	for _, path := range []string{"/admin/connections", "/admin/kick?id=1"} {
+		if resp := adminRequest(t, h, http.MethodPost, path, "user-token"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s with a user token returned %s, want 401", path, resp.Status)
+		}
+	}
+}
+
+func TestAdminDisabledWithoutAuthenticator(t *testing.T) {
+	s := NewServer()
+	s.Authenticate = tokenAuth("user-token", "alice")
+	h := startAdmin(t, s)
+
+	if resp := adminRequest(t, h, http.MethodGet, "/admin/connections", "user-token"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("admin endpoint without AdminAuthenticate returned %s, want 403", resp.Status)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Authenticator identifies the user behind an upgrade request. Returning an
+// error rejects the request with 401 Unauthorized before it is upgraded.
+type Authenticator func(r *http.Request) (userID string, err error)
+
+// RequestToken returns the bearer token from the Authorization header, or
+// the token query parameter when no header is present. Browsers cannot set
+// headers on WebSocket requests, so they have to use the query parameter.
+func RequestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			return ""
+		}
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("token")
+}
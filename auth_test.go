@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialStatus attempts an upgrade and returns the handshake response status.
+func dialStatus(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	return resp.StatusCode
+}
+
+// userIDHandler replies with the user ID found in the handler context.
+type userIDHandler struct{}
+
+func (userIDHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	id, _ := UserIDFromContext(ctx)
+	return []byte(`"` + id + `"`), nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := NewServer()
+	s.Handler = userIDHandler{}
+	s.Authenticate = func(r *http.Request) (string, error) {
+		if RequestToken(r) != "secret" {
+			return "", errors.New("bad token")
+		}
+		return "alice", nil
+	}
+	h := startServer(t, s)
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		header http.Header
+		want   int
+	}{
+		{"no token", "", nil, http.StatusUnauthorized},
+		{"bad query token", "?token=guess", nil, http.StatusUnauthorized},
+		{"bad header token", "", http.Header{"Authorization": {"Bearer guess"}}, http.StatusUnauthorized},
+		{"query token", "?token=secret", nil, http.StatusSwitchingProtocols},
+		{"header token", "", http.Header{"Authorization": {"Bearer secret"}}, http.StatusSwitchingProtocols},
+	} {
+		if got := dialStatus(t, h.URL("/ws"+tc.query), tc.header); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	c := h.Dial("/ws?token=secret")
+	c.Send([]byte(`{}`))
+	c.ExpectJSON(`"alice"`)
+}
+
+func TestRequestToken(t *testing.T) {
+	for _, tc := range []struct {
+		url, auth, want string
+	}{
+		{"/ws?token=q", "", "q"},
+		{"/ws?token=q", "Bearer h", "h"},
+		{"/ws?token=q", "Basic h", ""},
+		{"/ws", "Bearer  h ", "h"},
+		{"/ws", "", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		if got := RequestToken(r); got != tc.want {
+			t.Errorf("RequestToken(%s, %q) = %q, want %q", tc.url, tc.auth, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Package client is a small WebSocket client for talking to the server. It
+// reconnects with exponential backoff when the connection drops, so reads
+// resume transparently on the new connection.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned once the client has been closed.
+var ErrClosed = errors.New("client: closed")
+
+// Options configures a Client. The zero value dials with
+// websocket.DefaultDialer and never reconnects.
+type Options struct {
+	Dialer *websocket.Dialer
+	Header http.Header
+	// MaxRetries is how many times the client tries to reconnect after
+	// the connection drops before giving up. Zero disables reconnection.
+	MaxRetries int
+	// InitialBackoff is the wait before the first reconnect attempt; it
+	// doubles after every failed attempt up to MaxBackoff. They default
+	// to 100ms and 5s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// OnReconnect runs after every successful reconnect, before reading
+	// resumes, so the caller can restore state such as joined rooms.
+	OnReconnect func(c *Client)
+}
+
+// Client is a WebSocket connection to a single URL. SendJSON and ReadJSON
+// may be called concurrently with each other.
+type Client struct {
+	url  string
+	opts Options
+
+	connMu  sync.Mutex
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	lastID  atomic.Uint64
+	pendMu  sync.Mutex
+	pending map[string]chan []byte
+
+	inbox     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	// err is the reason reading stopped. It is set before inbox is
+	// closed.
+	err error
+}
+
+// Dial connects to url and starts reading from it.
+func Dial(url string, opts Options) (*Client, error) {
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Second
+	}
+	c := &Client{
+		url:     url,
+		opts:    opts,
+		pending: make(map[string]chan []byte),
+		inbox:   make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Client) dial() (*websocket.Conn, error) {
+	dialer := c.opts.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.Dial(c.url, c.opts.Header)
+	return conn, err
+}
+
+func (c *Client) current() *websocket.Conn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn
+}
+
+// SendJSON writes v as a JSON text frame. It fails while the client is
+// reconnecting; the caller may retry once OnReconnect has run.
+func (c *Client) SendJSON(v any) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.current().WriteJSON(v)
+}
+
+// ReadJSON blocks until the next message arrives and decodes it into v.
+// Once the client is closed, or reconnecting has failed, it returns the
+// reason reading stopped.
+func (c *Client) ReadJSON(v any) error {
+	data, ok := <-c.inbox
+	if !ok {
+		return c.err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Request sends msg, which must encode to a JSON object, with a fresh "id"
+// field and waits for the reply carrying the same id. Replies may arrive in
+// any order; messages without a pending id are still delivered to ReadJSON.
+func (c *Client) Request(ctx context.Context, msg any) (json.RawMessage, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("client: request must be a JSON object: %w", err)
+	}
+	id := strconv.FormatUint(c.lastID.Add(1), 10)
+	fields["id"], _ = json.Marshal(id)
+
+	reply := make(chan []byte, 1)
+	c.pendMu.Lock()
+	c.pending[id] = reply
+	c.pendMu.Unlock()
+	defer func() {
+		c.pendMu.Lock()
+		delete(c.pending, id)
+		c.pendMu.Unlock()
+	}()
+
+	if err := c.SendJSON(fields); err != nil {
+		return nil, err
+	}
+	select {
+	case data := <-reply:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// dispatch hands data to the Request waiting for its id and reports whether
+// there was one.
+func (c *Client) dispatch(data []byte) bool {
+	var envelope struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(data, &envelope) != nil || envelope.ID == "" {
+		return false
+	}
+	c.pendMu.Lock()
+	reply, ok := c.pending[envelope.ID]
+	delete(c.pending, envelope.ID)
+	c.pendMu.Unlock()
+	if ok {
+		reply <- data
+	}
+	return ok
+}
+
+// Close sends a normal close frame and closes the connection. Pending and
+// later reads return ErrClosed.
+func (c *Client) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.done)
+		conn := c.current()
+		c.writeMu.Lock()
+		msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		c.writeMu.Unlock()
+		err = conn.Close()
+	})
+	return err
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) readLoop() {
+	defer close(c.inbox)
+	for {
+		_, data, err := c.current().ReadMessage()
+		if err == nil {
+			if c.dispatch(data) {
+				continue
+			}
+			select {
+			case c.inbox <- data:
+				continue
+			case <-c.done:
+				c.err = ErrClosed
+				return
+			}
+		}
+		if c.closed() {
+			c.err = ErrClosed
+			return
+		}
+		if c.opts.MaxRetries <= 0 {
+			c.err = err
+			return
+		}
+		if err := c.reconnect(); err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+// reconnect replaces the dropped connection, backing off exponentially
+// between attempts.
+func (c *Client) reconnect() error {
+	c.current().Close()
+	backoff := c.opts.InitialBackoff
+	var err error
+	for attempt := 0; attempt < c.opts.MaxRetries; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return ErrClosed
+		}
+		var conn *websocket.Conn
+		conn, err = c.dial()
+		if err != nil {
+			backoff = min(backoff*2, c.opts.MaxBackoff)
+			continue
+		}
+		c.connMu.Lock()
+		if c.closed() {
+			c.connMu.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+		c.conn = conn
+		c.connMu.Unlock()
+		if c.opts.OnReconnect != nil {
+			c.opts.OnReconnect(c)
+		}
+		return nil
+	}
+	return fmt.Errorf("client: reconnect failed after %d attempts: %w", c.opts.MaxRetries, err)
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Websocket/testutil"
+	"github.com/gorilla/websocket"
+)
+
+// echoServer echoes every message back. The first connection is dropped
+// without a close frame after its first echo.
+func echoServer(t *testing.T) *testutil.Harness {
+	var conns atomic.Int32
+	return testutil.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		first := conns.Add(1) == 1
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(typ, msg); err != nil || first {
+				return
+			}
+		}
+	}))
+}
+
+func TestReconnectResumes(t *testing.T) {
+	h := echoServer(t)
+	reconnected := make(chan struct{}, 1)
+	c, err := Dial(h.URL("/"), Options{
+		MaxRetries:     3,
+		InitialBackoff: 10 * time.Millisecond,
+		OnReconnect:    func(*Client) { reconnected <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got map[string]string
+	if err := c.SendJSON(map[string]string{"n": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(&got); err != nil || got["n"] != "1" {
+		t.Fatalf("first echo: %v, %v", got, err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect after the server dropped it")
+	}
+	if err := c.SendJSON(map[string]string{"n": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(&got); err != nil || got["n"] != "2" {
+		t.Fatalf("echo after reconnecting: %v, %v", got, err)
+	}
+}
+
+func TestNoReconnectWithoutRetries(t *testing.T) {
+	h := echoServer(t)
+	c, err := Dial(h.URL("/"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got map[string]string
+	c.SendJSON(map[string]string{"n": "1"})
+	if err := c.ReadJSON(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReadJSON(&got); err == nil {
+		t.Fatal("ReadJSON succeeded after the connection dropped")
+	}
+}
+
+// reverseServer reads two messages and answers them in reverse order,
+// followed by a message that answers no request.
+func reverseServer(t *testing.T) *testutil.Harness {
+	return testutil.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		var requests [2][]byte
+		for i := range requests {
+			if _, requests[i], err = ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+		ws.WriteMessage(websocket.TextMessage, requests[1])
+		ws.WriteMessage(websocket.TextMessage, requests[0])
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"event":"unsolicited"}`))
+		ws.ReadMessage()
+	}))
+}
+
+func TestRequestOutOfOrderReplies(t *testing.T) {
+	c, err := Dial(reverseServer(t).URL("/"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	replies := make(chan map[string]string, 2)
+	for _, n := range []string{"first", "second"} {
+		go func(n string) {
+			data, err := c.Request(ctx, map[string]string{"n": n})
+			if err != nil {
+				t.Error(err)
+				replies <- nil
+				return
+			}
+			var reply map[string]string
+			if err := json.Unmarshal(data, &reply); err != nil {
+				t.Error(err)
+			}
+			if reply["n"] != n {
+				t.Errorf("request %s got reply %v", n, reply)
+			}
+			replies <- reply
+		}(n)
+	}
+	if a, b := <-replies, <-replies; a != nil && b != nil && a["id"] == b["id"] {
+		t.Errorf("both requests were sent with id %s", a["id"])
+	}
+
+	var msg map[string]string
+	if err := c.ReadJSON(&msg); err != nil || msg["event"] != "unsolicited" {
+		t.Fatalf("ReadJSON got %v, %v, want the message that answers no request", msg, err)
+	}
+}
+
+func TestRequestContextExpires(t *testing.T) {
+	c, err := Dial(reverseServer(t).URL("/"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The server answers nothing until it has two requests.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Request(ctx, map[string]string{"n": "alone"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Request returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a single client connection. All writes go through writer, and
+// log carries the connection's identifying fields.
+type Conn struct {
+	id     string
+	userID string
+	// subprotocol is the negotiated Sec-WebSocket-Protocol, if any.
+	subprotocol string
+	remoteAddr  string
+	ws          *websocket.Conn
+	log         *slog.Logger
+	metrics     *Metrics
+	stats       *connStats
+	writer      *connWriter
+	// compressed reports whether permessage-deflate was negotiated.
+	compressed bool
+
+	// lastMessageAt is the UnixNano time of the last application message
+	// read from the client. Control frames such as pongs do not touch it.
+	lastMessageAt atomic.Int64
+	// decodeFailures counts consecutive malformed messages. Only the read
+	// loop touches it.
+	decodeFailures int
+}
+
+// ID returns the identifier assigned to the connection when it was
+// upgraded. It is unique for the lifetime of the server.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// UserID returns the user the Authenticator identified, or "" when the
+// server does not authenticate.
+func (c *Conn) UserID() string {
+	return c.userID
+}
+
+// Subprotocol returns the subprotocol negotiated during the upgrade, or ""
+// when the client requested none the server supports.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// close ends the connection from the server side with a proper close
+// handshake instead of a bare TCP close: the close frame is queued behind any
+// pending writes, flushed, and only then is the socket closed. reason is what
+// the client sees in the close frame, so it should say why it was dropped.
+func (c *Conn) close(code int, reason string) error {
+	err := c.writer.Send(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	c.writer.Close()
+	c.ws.Close()
+	return err
+}
+
+// closeContext is close bounded by ctx. If the queue has not drained when
+// ctx is done, typically because the client stopped reading, the close
+// frame is written directly with ctx's deadline instead and the socket is
+// closed, which also stops the writer.
+func (c *Conn) closeContext(ctx context.Context, code int, reason string) error {
+	closed := make(chan error, 1)
+	go func() { closed <- c.close(code, reason) }()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+	}
+	d, ok := ctx.Deadline()
+	if !ok {
+		d = time.Now()
+	}
+	err := c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), d)
+	c.ws.Close()
+	return err
+}
+
+// Stats returns a snapshot of the connection's traffic counters. It is safe
+// to call at any time, including after the connection has closed.
+func (c *Conn) Stats() ConnStats {
+	stats := c.stats.snapshot()
+	stats.Compressed = c.compressed
+	return stats
+}
+
+// RemoteAddr returns the client's network address as seen by the server.
+func (c *Conn) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *Conn) touch() {
+	c.lastMessageAt.Store(time.Now().UnixNano())
+}
+
+// idleFor returns how long ago the client last sent a message.
+func (c *Conn) idleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastMessageAt.Load()))
+}
+
+type (
+	connIDKey struct{}
+	userIDKey struct{}
+)
+
+// ConnIDFromContext returns the ID of the connection whose message is being
+// handled, for MessageHandler implementations that want to log against it.
+func ConnIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(connIDKey{}).(string)
+	return id, ok
+}
+
+// UserIDFromContext returns the authenticated user of the connection whose
+// message is being handled.
+func UserIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(userIDKey{}).(string)
+	return id, ok && id != ""
+}
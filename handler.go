@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// MessageHandler processes a single inbound frame and returns the frame to
+// send back to the client. A nil reply sends nothing. An error closes the
+// connection, except for JSON decode errors (*json.SyntaxError and
+// *json.UnmarshalTypeError, possibly wrapped) and errors wrapping
+// ErrRejected, which are reported back to the client as an error reply.
+//
+// ctx is cancelled as soon as the connection ends, even while Handle is
+// still running, so handlers can abort work the client no longer waits for.
+//
+// Clients match replies to requests by an "id" field. A handler that builds
+// a fresh reply instead of echoing the message must copy the request's id
+// onto it, which ReplyTo does.
+type MessageHandler interface {
+	Handle(ctx context.Context, msg []byte) ([]byte, error)
+}
+
+// EchoHandler echoes every JSON object back with a "reply" field added.
+// Because the whole message is echoed, an "id" field comes back unchanged,
+// and so does a "reply" field the client sent itself. Anything other than
+// an object, including null, is answered like malformed JSON.
+type EchoHandler struct{}
+
+func (EchoHandler) Handle(ctx context.Context, data []byte) ([]byte, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("decoding json: %w", err)
+	}
+	if msg == nil {
+		return nil, errNotObject
+	}
+	if _, ok := msg["reply"]; !ok {
+		msg["reply"] = replyReceived
+	}
+	return json.Marshal(msg)
+}
+
+// BinaryEchoHandler echoes every frame back unchanged.
+type BinaryEchoHandler struct{}
+
+func (BinaryEchoHandler) Handle(ctx context.Context, data []byte) ([]byte, error) {
+	return data, nil
+}
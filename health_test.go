@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readyzStatus(t *testing.T, s *Server) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	s := NewServer()
+	c := startServer(t, s).Dial("/ws")
+	waitForConns(t, s, 1)
+	if code := readyzStatus(t, s); code != http.StatusOK {
+		t.Fatalf("/readyz before shutdown returned %d", code)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Drain(context.Background()) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for readyzStatus(t, s) != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("/readyz kept reporting ready after shutdown began")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if ids := s.Hub.ConnIDs(); len(ids) != 1 {
+		t.Fatalf("connections %v, want the client still draining", ids)
+	}
+
+	c.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+// history is a fixed-size ring of a room's most recent broadcasts, replayed
+// to connections that join the room late. Only the hub goroutine uses it.
+type history struct {
+	msgs [][]byte
+	// next is where the following message goes; once the ring is full it
+	// is also the oldest message.
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{msgs: make([][]byte, size)}
+}
+
+func (r *history) add(msg []byte) {
+	r.msgs[r.next] = msg
+	r.next = (r.next + 1) % len(r.msgs)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// messages returns the buffered messages, oldest first.
+func (r *history) messages() [][]byte {
+	if !r.full {
+		return r.msgs[:r.next]
+	}
+	out := make([][]byte, 0, len(r.msgs))
+	out = append(out, r.msgs[r.next:]...)
+	return append(out, r.msgs[:r.next]...)
+}
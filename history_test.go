@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestHistoryRing(t *testing.T) {
+	r := newHistory(3)
+	var want []string
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprint(i)
+		r.add([]byte(msg))
+		want = append(want, msg)
+		if len(want) > 3 {
+			want = want[1:]
+		}
+		var got []string
+		for _, m := range r.messages() {
+			got = append(got, string(m))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("after adding %d messages got %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestJoinReplaysHistory(t *testing.T) {
+	s := NewServer()
+	s.Hub.KeepHistory("feed", 10)
+	h := startServer(t, s)
+	for i := 1; i <= 5; i++ {
+		s.Hub.BroadcastToRoom("feed", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	c := h.Dial("/ws")
+	c.SendJSON(map[string]string{"type": "join", "room": "feed"})
+	for i := 1; i <= 5; i++ {
+		c.ExpectJSON(fmt.Sprintf(`{"n":%d}`, i))
+	}
+	// Live messages follow the replay without a gap or a duplicate.
+	s.Hub.BroadcastToRoom("feed", []byte(`{"n":6}`))
+	c.ExpectJSON(`{"n":6}`)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrUserNotConnected is returned by SendToUser when the user has no open
+// connections.
+var ErrUserNotConnected = errors.New("user has no active connections")
+
+// Hub fans messages out to registered connections, either to everyone or
+// to the members of a named room. Connections that subscribed to event
+// types only receive broadcasts whose "type" field is one of them. All
+// state is owned by the run goroutine; the exported methods only talk to it
+// over channels.
+type Hub struct {
+	register   chan *Conn
+	unregister chan *Conn
+	join       chan membership
+	leave      chan membership
+	subscribe  chan subscription
+	keep       chan historySize
+	coalesce   chan coalescing
+	broadcast  chan roomMessage
+	direct     chan directMessage
+	list       chan chan []string
+	stats      chan chan map[string]ConnStats
+	quit       chan struct{}
+	stopOnce   sync.Once
+
+	conns map[*Conn]*member
+	rooms map[string]map[*Conn]struct{}
+	// byEvent indexes subscribed connections by event type, and
+	// unfiltered holds the connections without subscriptions, so a
+	// broadcast never scans connections that do not want it.
+	byEvent    map[string]map[*Conn]struct{}
+	unfiltered map[*Conn]struct{}
+	// history holds the recent broadcasts of rooms configured with
+	// KeepHistory. It outlives the room's members.
+	history map[string]*history
+	// users indexes connections by authenticated user ID; a user may have
+	// several connections open at once.
+	users map[string]map[*Conn]struct{}
+
+	// When window is set, messages for each connection collect in pending
+	// and go out as one JSON array when the window closes or the batch
+	// reaches maxBatch. flushC is nil while nothing is pending.
+	window   time.Duration
+	maxBatch int
+	pending  map[*Conn][][]byte
+	flushC   <-chan time.Time
+}
+
+// member is the hub's view of one registered connection.
+type member struct {
+	rooms map[string]struct{}
+	// events is the set of subscribed event types; empty means all.
+	events map[string]struct{}
+	// individual opts the connection out of coalescing.
+	individual bool
+}
+
+type subscription struct {
+	conn   *Conn
+	events []string
+	add    bool
+}
+
+// coalescing configures the hub-wide batching window, or, with conn set,
+// whether that connection takes part.
+type coalescing struct {
+	window   time.Duration
+	maxBatch int
+	conn     *Conn
+	on       bool
+}
+
+type historySize struct {
+	room string
+	size int
+}
+
+type directMessage struct {
+	userID string
+	msg    []byte
+	result chan error
+}
+
+type membership struct {
+	conn *Conn
+	room string
+}
+
+// roomMessage is a broadcast; an empty room means every connection.
+type roomMessage struct {
+	room string
+	msg  []byte
+}
+
+func NewHub() *Hub {
+	h := &Hub{
+		register:   make(chan *Conn),
+		unregister: make(chan *Conn),
+		join:       make(chan membership),
+		leave:      make(chan membership),
+		subscribe:  make(chan subscription),
+		keep:       make(chan historySize),
+		coalesce:   make(chan coalescing),
+		broadcast:  make(chan roomMessage),
+		direct:     make(chan directMessage),
+		list:       make(chan chan []string),
+		stats:      make(chan chan map[string]ConnStats),
+		quit:       make(chan struct{}),
+		conns:      make(map[*Conn]*member),
+		rooms:      make(map[string]map[*Conn]struct{}),
+		byEvent:    make(map[string]map[*Conn]struct{}),
+		unfiltered: make(map[*Conn]struct{}),
+		history:    make(map[string]*history),
+		users:      make(map[string]map[*Conn]struct{}),
+		pending:    make(map[*Conn][][]byte),
+	}
+	go h.run()
+	return h
+}
+
+func (h *Hub) Register(c *Conn) {
+	select {
+	case h.register <- c:
+	case <-h.quit:
+	}
+}
+
+// Unregister removes c from the hub and from every room it joined.
+func (h *Hub) Unregister(c *Conn) {
+	select {
+	case h.unregister <- c:
+	case <-h.quit:
+	}
+}
+
+// Join subscribes a registered connection to room. If the room keeps a
+// history, it is replayed to c before any later broadcast.
+func (h *Hub) Join(c *Conn, room string) {
+	select {
+	case h.join <- membership{conn: c, room: room}:
+	case <-h.quit:
+	}
+}
+
+func (h *Hub) Leave(c *Conn, room string) {
+	select {
+	case h.leave <- membership{conn: c, room: room}:
+	case <-h.quit:
+	}
+}
+
+// Subscribe limits the broadcasts c receives to the given event types, in
+// addition to any it already subscribed to.
+func (h *Hub) Subscribe(c *Conn, events []string) {
+	select {
+	case h.subscribe <- subscription{conn: c, events: events, add: true}:
+	case <-h.quit:
+	}
+}
+
+// Unsubscribe removes event types from c's subscriptions. With no events it
+// removes them all, so c receives every broadcast again.
+func (h *Hub) Unsubscribe(c *Conn, events []string) {
+	select {
+	case h.subscribe <- subscription{conn: c, events: events}:
+	case <-h.quit:
+	}
+}
+
+// KeepHistory makes room remember its last size broadcasts and replay them,
+// oldest first, to every connection that joins it. Replayed messages go
+// through the same send buffer as live ones, so size should not exceed
+// Server.SendBufferSize. Resizing discards the current history, and a size
+// of zero turns it off.
+func (h *Hub) KeepHistory(room string, size int) {
+	select {
+	case h.keep <- historySize{room: room, size: size}:
+	case <-h.quit:
+	}
+}
+
+// Coalesce batches everything the hub sends to a connection over window
+// into a single frame holding a JSON array of the messages, for high-rate
+// feeds where a frame per message is too costly. A batch is sent as soon as
+// it holds maxBatch messages, so neither latency nor memory grows without
+// bound. Coalesced messages must be JSON values. A zero window sends every
+// message as its own frame again.
+func (h *Hub) Coalesce(window time.Duration, maxBatch int) {
+	select {
+	case h.coalesce <- coalescing{window: window, maxBatch: max(maxBatch, 1)}:
+	case <-h.quit:
+	}
+}
+
+// SetCoalescing opts c in or out of coalescing; connections take part by
+// default. A connection that opts out receives every message as its own
+// frame.
+func (h *Hub) SetCoalescing(c *Conn, on bool) {
+	select {
+	case h.coalesce <- coalescing{conn: c, on: on}:
+	case <-h.quit:
+	}
+}
+
+// Broadcast sends msg as a text frame to every registered connection that
+// wants its event type.
+func (h *Hub) Broadcast(msg []byte) {
+	h.BroadcastToRoom("", msg)
+}
+
+// BroadcastToRoom sends msg as a text frame to the members of room that
+// want its event type.
+func (h *Hub) BroadcastToRoom(room string, msg []byte) {
+	select {
+	case h.broadcast <- roomMessage{room: room, msg: msg}:
+	case <-h.quit:
+	}
+}
+
+// SendToUser sends msg as a text frame to every connection of userID. It
+// returns ErrUserNotConnected when the user has none.
+func (h *Hub) SendToUser(userID string, msg []byte) error {
+	result := make(chan error, 1)
+	select {
+	case h.direct <- directMessage{userID: userID, msg: msg, result: result}:
+		return <-result
+	case <-h.quit:
+		return ErrUserNotConnected
+	}
+}
+
+// ConnIDs returns the IDs of every registered connection.
+func (h *Hub) ConnIDs() []string {
+	reply := make(chan []string, 1)
+	select {
+	case h.list <- reply:
+		return <-reply
+	case <-h.quit:
+		return nil
+	}
+}
+
+// Stats returns a snapshot of every registered connection's stats, keyed
+// by connection ID.
+func (h *Hub) Stats() map[string]ConnStats {
+	reply := make(chan map[string]ConnStats, 1)
+	select {
+	case h.stats <- reply:
+		return <-reply
+	case <-h.quit:
+		return nil
+	}
+}
+
+// Stop shuts the hub goroutine down. Later calls to the hub are no-ops.
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.quit) })
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.add(c)
+		case c := <-h.unregister:
+			h.remove(c)
+		case m := <-h.join:
+			h.addToRoom(m.conn, m.room)
+		case m := <-h.leave:
+			h.removeFromRoom(m.conn, m.room)
+		case sub := <-h.subscribe:
+			h.updateSubscription(sub)
+		case cfg := <-h.coalesce:
+			h.configureCoalescing(cfg)
+		case <-h.flushC:
+			h.flushAll()
+		case k := <-h.keep:
+			if k.size > 0 {
+				h.history[k.room] = newHistory(k.size)
+			} else {
+				delete(h.history, k.room)
+			}
+		case m := <-h.broadcast:
+			h.fanOut(m)
+		case m := <-h.direct:
+			conns := h.users[m.userID]
+			if len(conns) == 0 {
+				m.result <- ErrUserNotConnected
+				continue
+			}
+			for c := range conns {
+				h.deliver(c, m.msg)
+			}
+			m.result <- nil
+		case reply := <-h.list:
+			ids := make([]string, 0, len(h.conns))
+			for c := range h.conns {
+				ids = append(ids, c.id)
+			}
+			reply <- ids
+		case reply := <-h.stats:
+			stats := make(map[string]ConnStats, len(h.conns))
+			for c := range h.conns {
+				stats[c.id] = c.Stats()
+			}
+			reply <- stats
+		case <-h.quit:
+			return
+		}
+	}
+}
+
+func (h *Hub) add(c *Conn) {
+	if _, ok := h.conns[c]; ok {
+		return
+	}
+	h.conns[c] = &member{
+		rooms:  make(map[string]struct{}),
+		events: make(map[string]struct{}),
+	}
+	h.unfiltered[c] = struct{}{}
+	if c.userID != "" {
+		addToSet(h.users, c.userID, c)
+	}
+}
+
+// eventType returns the event type of msg for subscription matching.
+// Without subscribers every connection is unfiltered, so the message does
+// not need to be parsed.
+func (h *Hub) eventType(msg []byte) string {
+	if len(h.byEvent) == 0 {
+		return ""
+	}
+	return eventType(msg)
+}
+
+func (h *Hub) fanOut(m roomMessage) {
+	event := h.eventType(m.msg)
+	if m.room != "" {
+		if hist, ok := h.history[m.room]; ok {
+			hist.add(m.msg)
+		}
+		for c := range h.rooms[m.room] {
+			if h.wants(c, event) {
+				h.deliver(c, m.msg)
+			}
+		}
+		return
+	}
+	for c := range h.unfiltered {
+		h.deliver(c, m.msg)
+	}
+	if event != "" {
+		for c := range h.byEvent[event] {
+			h.deliver(c, m.msg)
+		}
+	}
+}
+
+func (h *Hub) wants(c *Conn, event string) bool {
+	m, ok := h.conns[c]
+	if !ok {
+		return false
+	}
+	if len(m.events) == 0 {
+		return true
+	}
+	_, ok = m.events[event]
+	return ok
+}
+
+// addToRoom adds c to room and replays the room's history to it. Both
+// happen on the hub goroutine, so no broadcast can fall between the replay
+// and the first live message, or be seen twice.
+func (h *Hub) addToRoom(c *Conn, room string) {
+	m, ok := h.conns[c]
+	if !ok {
+		return
+	}
+	if _, joined := m.rooms[room]; joined {
+		return
+	}
+	addToSet(h.rooms, room, c)
+	m.rooms[room] = struct{}{}
+	if hist, ok := h.history[room]; ok {
+		for _, msg := range hist.messages() {
+			if h.wants(c, h.eventType(msg)) {
+				h.deliver(c, msg)
+			}
+		}
+	}
+}
+
+// removeFromRoom drops c from room, deleting the room once it is empty.
+func (h *Hub) removeFromRoom(c *Conn, room string) {
+	if m, ok := h.conns[c]; ok {
+		delete(m.rooms, room)
+	}
+	removeFromSet(h.rooms, room, c)
+}
+
+func (h *Hub) updateSubscription(sub subscription) {
+	m, ok := h.conns[sub.conn]
+	if !ok {
+		return
+	}
+	if sub.add {
+		for _, event := range sub.events {
+			m.events[event] = struct{}{}
+			addToSet(h.byEvent, event, sub.conn)
+		}
+	} else {
+		events := sub.events
+		if len(events) == 0 {
+			for event := range m.events {
+				events = append(events, event)
+			}
+		}
+		for _, event := range events {
+			delete(m.events, event)
+			removeFromSet(h.byEvent, event, sub.conn)
+		}
+	}
+	if len(m.events) == 0 {
+		h.unfiltered[sub.conn] = struct{}{}
+	} else {
+		delete(h.unfiltered, sub.conn)
+	}
+}
+
+func (h *Hub) remove(c *Conn) {
+	m, ok := h.conns[c]
+	if !ok {
+		return
+	}
+	for room := range m.rooms {
+		removeFromSet(h.rooms, room, c)
+	}
+	for event := range m.events {
+		removeFromSet(h.byEvent, event, c)
+	}
+	delete(h.conns, c)
+	delete(h.unfiltered, c)
+	delete(h.pending, c)
+	removeFromSet(h.users, c.userID, c)
+}
+
+func addToSet(index map[string]map[*Conn]struct{}, key string, c *Conn) {
+	set, ok := index[key]
+	if !ok {
+		set = make(map[*Conn]struct{})
+		index[key] = set
+	}
+	set[c] = struct{}{}
+}
+
+// removeFromSet drops c from index[key], deleting the key once its set is
+// empty so rooms and event types do not accumulate.
+func removeFromSet(index map[string]map[*Conn]struct{}, key string, c *Conn) {
+	set, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(set, c)
+	if len(set) == 0 {
+		delete(index, key)
+	}
+}
+
+func (h *Hub) configureCoalescing(cfg coalescing) {
+	if cfg.conn == nil {
+		h.flushAll()
+		h.window, h.maxBatch = cfg.window, cfg.maxBatch
+		return
+	}
+	m, ok := h.conns[cfg.conn]
+	if !ok {
+		return
+	}
+	if !cfg.on {
+		// Flush first so nothing buffered overtakes, or trails behind,
+		// the individual frames that follow.
+		h.flush(cfg.conn)
+	}
+	m.individual = !cfg.on
+}
+
+// deliver hands msg to c, batching it when coalescing is on.
+func (h *Hub) deliver(c *Conn, msg []byte) {
+	if m, ok := h.conns[c]; !ok || h.window <= 0 || m.individual {
+		h.send(c, msg)
+		return
+	}
+	batch := append(h.pending[c], msg)
+	h.pending[c] = batch
+	if len(batch) >= h.maxBatch {
+		h.flush(c)
+		return
+	}
+	if h.flushC == nil {
+		h.flushC = time.After(h.window)
+	}
+}
+
+// flush sends c's pending batch as one JSON array.
+func (h *Hub) flush(c *Conn) {
+	batch, ok := h.pending[c]
+	if !ok {
+		return
+	}
+	delete(h.pending, c)
+	h.send(c, append(append([]byte{'['}, bytes.Join(batch, []byte{','})...), ']'))
+}
+
+func (h *Hub) flushAll() {
+	h.flushC = nil
+	for c := range h.pending {
+		h.flush(c)
+	}
+}
+
+// send queues msg on c without blocking. A client that cannot keep up
+// misses the message, and its writer evicts it if it stays stuck, so it
+// cannot stall delivery to everyone else.
+func (h *Hub) send(c *Conn, msg []byte) {
+	switch err := c.writer.TrySend(websocket.TextMessage, msg); err {
+	case errSendBufferFull:
+		c.log.Debug("send buffer full, dropping message", "event", "send_buffer_full")
+		c.metrics.error("send_buffer_full")
+	case errWriterClosed:
+		h.remove(c)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"Websocket/testutil"
+)
+
+func TestBroadcastReachesEveryClient(t *testing.T) {
+	s := NewServer()
+	h := startServer(t, s)
+	clients := []*testutil.Client{h.Dial("/ws"), h.Dial("/ws"), h.Dial("/ws")}
+	waitForConns(t, s, len(clients))
+
+	s.Hub.Broadcast([]byte(`{"hello":"all"}`))
+	for _, c := range clients {
+		c.ExpectJSON(`{"hello":"all"}`)
+	}
+}
+
+func TestRoomBroadcastIsIsolated(t *testing.T) {
+	s := NewServer()
+	h := startServer(t, s)
+	inRoom, outside := h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 2)
+
+	// Replies are sent after the hub has handled the join, so waiting for
+	// one orders the join before the broadcast.
+	inRoom.SendJSON(map[string]string{"type": "join", "room": "lobby"})
+	inRoom.SendJSON(map[string]string{"hello": "world"})
+	inRoom.ExpectJSON(`{"hello":"world","reply":"Message received"}`)
+
+	s.Hub.BroadcastToRoom("lobby", []byte(`{"room":"lobby"}`))
+	s.Hub.Broadcast([]byte(`{"room":"everyone"}`))
+	inRoom.ExpectJSON(`{"room":"lobby"}`)
+	inRoom.ExpectJSON(`{"room":"everyone"}`)
+	outside.ExpectJSON(`{"room":"everyone"}`)
+}
+
+func TestEmptyRoomIsRemoved(t *testing.T) {
+	h := NewHub()
+	defer h.Stop()
+	a, b := &Conn{id: "a"}, &Conn{id: "b"}
+	h.Register(a)
+	h.Register(b)
+	h.Join(a, "lobby")
+	h.Join(b, "lobby")
+	h.Leave(a, "lobby")
+	h.Unregister(b)
+
+	// ConnIDs is answered by the hub goroutine after the calls above, so
+	// its maps can be inspected once it returns.
+	h.ConnIDs()
+	if _, ok := h.rooms["lobby"]; ok {
+		t.Fatalf("room still tracked after its last member left: %v", h.rooms)
+	}
+}
+
+func TestStalledReaderIsEvicted(t *testing.T) {
+	s := NewServer()
+	s.SendBufferSize = 4
+	s.SendTimeout = 100 * time.Millisecond
+	s.WriteDeadline = 0
+	causes := make(chan error, 2)
+	s.OnDisconnect = func(c *Conn, err error) { causes <- err }
+	h := startServer(t, s)
+	stalled := h.Dial("/ws") // never reads
+	defer stalled.Close()
+	fast := h.Dial("/ws")
+	waitForConns(t, s, 2)
+	go func() {
+		for {
+			if _, _, err := fast.Conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Frames far larger than the socket buffers stall the writer of the
+	// client that does not read, so its queue fills and stays full.
+	payload := []byte(`"` + strings.Repeat("x", 64<<10) + `"`)
+	timeout := time.After(2 * time.Second)
+	for {
+		start := time.Now()
+		s.Hub.Broadcast(payload)
+		if d := time.Since(start); d > s.SendTimeout {
+			t.Fatalf("broadcast took %v, the producer blocked on the stalled client", d)
+		}
+		select {
+		case err := <-causes:
+			if !errors.Is(err, errSendBufferFull) {
+				t.Fatalf("disconnect cause %v, want %v", err, errSendBufferFull)
+			}
+			if ids := s.Hub.ConnIDs(); len(ids) != 1 {
+				t.Fatalf("connections %v, want only the reading client", ids)
+			}
+			return
+		case <-timeout:
+			t.Fatal("stalled client was never evicted")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestSendToUser(t *testing.T) {
+	s := NewServer()
+	s.Authenticate = func(r *http.Request) (string, error) { return RequestToken(r), nil }
+	h := startServer(t, s)
+	aliceLaptop, alicePhone := h.Dial("/ws?token=alice"), h.Dial("/ws?token=alice")
+	bob := h.Dial("/ws?token=bob")
+	waitForConns(t, s, 3)
+
+	if err := s.Hub.SendToUser("alice", []byte(`{"to":"alice"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Hub.SendToUser("carol", []byte(`{"to":"carol"}`)); !errors.Is(err, ErrUserNotConnected) {
+		t.Fatalf("sending to a user without connections returned %v", err)
+	}
+	s.Hub.Broadcast([]byte(`{"to":"everyone"}`))
+
+	aliceLaptop.ExpectJSON(`{"to":"alice"}`)
+	alicePhone.ExpectJSON(`{"to":"alice"}`)
+	bob.ExpectJSON(`{"to":"everyone"}`)
+}
+
+// sendControl sends a control message on c and waits until the server has
+// handled it, using the reply to a message sent right after it.
+func sendControl(c *testutil.Client, msg map[string]any) {
+	c.SendJSON(msg)
+	c.SendJSON(map[string]string{"sync": "1"})
+	c.ExpectJSON(`{"sync":"1","reply":"Message received"}`)
+}
+
+func TestSubscriptionsFilterBroadcasts(t *testing.T) {
+	s := NewServer()
+	h := startServer(t, s)
+	prices, trades, everything := h.Dial("/ws"), h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 3)
+	sendControl(prices, map[string]any{"type": "subscribe", "events": []string{"price"}})
+	sendControl(trades, map[string]any{"type": "subscribe", "events": []string{"trade"}})
+
+	price, trade := `{"type":"price","bid":1}`, `{"type":"trade","qty":2}`
+	s.Hub.Broadcast([]byte(price))
+	s.Hub.Broadcast([]byte(trade))
+	s.Hub.Broadcast([]byte(`{"type":"news"}`))
+	s.Hub.Broadcast([]byte(`{"type":"done"}`))
+
+	prices.ExpectJSON(price)
+	trades.ExpectJSON(trade)
+	for _, want := range []string{price, trade, `{"type":"news"}`, `{"type":"done"}`} {
+		everything.ExpectJSON(want)
+	}
+	// The next price is prices' next frame, so nothing else reached it.
+	marker := `{"type":"price","bid":3}`
+	s.Hub.Broadcast([]byte(marker))
+	prices.ExpectJSON(marker)
+
+	// After unsubscribing, a connection gets everything again.
+	sendControl(prices, map[string]any{"type": "unsubscribe", "events": []string{"price"}})
+	s.Hub.Broadcast([]byte(trade))
+	prices.ExpectJSON(trade)
+}
+
+func TestCoalescedBroadcasts(t *testing.T) {
+	s := NewServer()
+	s.SendBufferSize = 128 // room for every individual frame
+	s.Hub.Coalesce(20*time.Millisecond, 10)
+	h := startServer(t, s)
+	batched, individual := h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 2)
+	sendControl(individual, map[string]any{"type": "subscribe", "coalesce": false})
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		s.Hub.Broadcast([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	var frames, next int
+	for next < n {
+		var batch []struct{ N int }
+		batched.ReceiveJSON(&batch)
+		if len(batch) == 0 || len(batch) > 10 {
+			t.Fatalf("batch of %d messages, want 1 to 10", len(batch))
+		}
+		for _, msg := range batch {
+			if msg.N != next {
+				t.Fatalf("got message %d, want %d", msg.N, next)
+			}
+			next++
+		}
+		frames++
+	}
+	if frames >= n {
+		t.Errorf("%d messages arrived in %d frames, want them coalesced", n, frames)
+	}
+	for i := 0; i < n; i++ {
+		individual.ExpectJSON(fmt.Sprintf(`{"n":%d}`, i))
+	}
+
+	// A partial batch goes out when the window closes.
+	s.Hub.Broadcast([]byte(`{"n":-1}`))
+	batched.ExpectJSON(`[{"n":-1}]`)
+}
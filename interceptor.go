@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrRejected rejects a single message without ending the connection. An
+// interceptor or handler returning an error that wraps it, e.g.
+// fmt.Errorf("%w: payload too large", ErrRejected), has the client sent an
+// {"error":"message rejected"} reply with the error as its detail.
+var ErrRejected = errors.New("message rejected")
+
+// Interceptor wraps the MessageHandler of every inbound message, the way
+// Middleware wraps the HTTP endpoint. It can observe or rewrite the message
+// and the reply, or short-circuit by replying without calling next. It
+// rejects a message by returning an error wrapping ErrRejected; any other
+// error ends the connection like a handler error would.
+type Interceptor func(next MessageHandler) MessageHandler
+
+// HandlerFunc adapts a function to MessageHandler, mainly for interceptors.
+type HandlerFunc func(ctx context.Context, msg []byte) ([]byte, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	return f(ctx, msg)
+}
+
+// intercept wraps h in s.Interceptors. The first interceptor is the
+// outermost one and sees the message first.
+func (s *Server) intercept(h MessageHandler) MessageHandler {
+	for i := len(s.Interceptors) - 1; i >= 0; i-- {
+		h = s.Interceptors[i](h)
+	}
+	return h
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func uppercase(next MessageHandler) MessageHandler {
+	return HandlerFunc(func(ctx context.Context, msg []byte) ([]byte, error) {
+		return next.Handle(ctx, bytes.ToUpper(msg))
+	})
+}
+
+func TestInterceptorTransformsMessage(t *testing.T) {
+	s := NewServer()
+	seen := make(chan string, 1)
+	s.Interceptors = []Interceptor{
+		func(next MessageHandler) MessageHandler {
+			return HandlerFunc(func(ctx context.Context, msg []byte) ([]byte, error) {
+				id, _ := ConnIDFromContext(ctx)
+				seen <- id
+				return next.Handle(ctx, msg)
+			})
+		},
+		uppercase,
+	}
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{"hello":"world"}`))
+	c.ExpectJSON(`{"HELLO":"WORLD","reply":"Message received"}`)
+	if id := <-seen; id == "" {
+		t.Fatal("interceptor context has no connection ID")
+	}
+}
+
+func TestInterceptorRejectsMessage(t *testing.T) {
+	s := NewServer()
+	s.Interceptors = []Interceptor{
+		func(next MessageHandler) MessageHandler {
+			return HandlerFunc(func(ctx context.Context, msg []byte) ([]byte, error) {
+				if bytes.Contains(msg, []byte("forbidden")) {
+					return nil, fmt.Errorf("%w: forbidden word", ErrRejected)
+				}
+				return next.Handle(ctx, msg)
+			})
+		},
+	}
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{"say":"forbidden"}`))
+	c.ExpectJSON(`{"error":"message rejected","detail":"message rejected: forbidden word"}`)
+	c.Send([]byte(`{"say":"hello"}`))
+	c.ExpectJSON(`{"say":"hello","reply":"Message received"}`)
+}
+
+func TestInterceptorErrorEndsConnection(t *testing.T) {
+	s := NewServer()
+	captureLogs(s)
+	s.Interceptors = []Interceptor{
+		func(next MessageHandler) MessageHandler {
+			return HandlerFunc(func(ctx context.Context, msg []byte) ([]byte, error) {
+				return nil, errors.New("backend down")
+			})
+		},
+	}
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{}`))
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	if _, _, err := c.Conn.ReadMessage(); err == nil {
+		t.Fatal("connection stayed open after an interceptor error")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		trust  bool
+		header []string
+		want   string
+	}{
+		{"socket address", false, nil, "192.0.2.1"},
+		{"header ignored without trust", false, []string{"203.0.113.7"}, "192.0.2.1"},
+		{"trusted header", true, []string{"203.0.113.7"}, "203.0.113.7"},
+		{"last hop of a list", true, []string{"10.0.0.1, 203.0.113.7"}, "203.0.113.7"},
+		{"last of several headers", true, []string{"10.0.0.1", "198.51.100.2"}, "198.51.100.2"},
+		{"empty header", true, []string{""}, "192.0.2.1"},
+	} {
+		s := NewServer()
+		s.TrustProxy = tc.trust
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		for _, v := range tc.header {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPerIPLimit(t *testing.T) {
+	s := NewServer()
+	s.MaxConnectionsPerIP = 1
+	h := startServer(t, s)
+	first := h.Dial("/ws")
+
+	if got := dialStatus(t, h.URL("/ws"), nil); got != http.StatusTooManyRequests {
+		t.Fatalf("second connection from the same IP got %d, want 429", got)
+	}
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for dialStatus(t, h.URL("/ws"), nil) != http.StatusSwitchingProtocols {
+		if time.Now().After(deadline) {
+			t.Fatal("IP slot of a closed connection was never freed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPerIPLimitBehindProxy(t *testing.T) {
+	s := NewServer()
+	s.MaxConnectionsPerIP = 1
+	s.TrustProxy = true
+	h := startServer(t, s)
+	from := func(ip string) http.Header { return http.Header{"X-Forwarded-For": {ip}} }
+
+	h.DialHeader("/ws", from("203.0.113.7"))
+	h.DialHeader("/ws", from("198.51.100.2"))
+	if got := dialStatus(t, h.URL("/ws"), from("203.0.113.7")); got != http.StatusTooManyRequests {
+		t.Fatalf("second connection forwarded for the same IP got %d, want 429", got)
+	}
+}
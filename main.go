@@ -1,47 +1,95 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+const (
+	// drainTimeout is how long open connections get to finish on their
+	// own before they are closed, and shutdownTimeout how long the HTTP
+	// server then has to stop.
+	drainTimeout    = 20 * time.Second
+	shutdownTimeout = 10 * time.Second
+)
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Fatalf("Error upgrading connection: %v", err)
+func main() {
+	defaultAddr := ":8080"
+	if env := os.Getenv("ADDR"); env != "" {
+		defaultAddr = env
 	}
-	defer ws.Close()
-
-	for {
-		var msg map[string]string
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Error reading json: %v", err)
-			break
+	addr := flag.String("addr", defaultAddr, "listen address; falls back to $ADDR")
+	path := flag.String("path", "/ws", "HTTP path of the WebSocket endpoint")
+	flag.Parse()
+	if err := validateAddr(*addr); err != nil {
+		log.Fatalf("Invalid -addr %q: %v", *addr, err)
+	}
+	if !strings.HasPrefix(*path, "/") {
+		log.Fatalf("Invalid -path %q: must start with /", *path)
+	}
+
+	srv := NewServer(WithAddr(*addr), WithPath(*path))
+	srv.CertFile = os.Getenv("TLS_CERT_FILE")
+	srv.KeyFile = os.Getenv("TLS_KEY_FILE")
+	mux := http.NewServeMux()
+	mux.Handle(srv.Path, srv.HTTPHandler())
+	mux.Handle("/metrics", srv.Metrics.Handler())
+	mux.HandleFunc("/healthz", srv.handleHealthz)
+	mux.HandleFunc("/readyz", srv.handleReadyz)
+	mux.HandleFunc("/admin/connections", srv.adminOnly(srv.handleAdminConnections))
+	mux.HandleFunc("/admin/kick", srv.adminOnly(srv.handleAdminKick))
+	httpServer := &http.Server{Addr: srv.Addr, Handler: mux}
+
+	go func() {
+		scheme := "ws"
+		if srv.TLSEnabled() {
+			scheme = "wss"
 		}
-		fmt.Printf("Received: %v\n", msg)
-		msg["reply"] = "Message received"
-		err = ws.WriteJSON(msg)
-		if err != nil {
-			log.Printf("Error writing json: %v", err)
-			break
+		log.Printf("Server started on %s (%s://, path %s)", httpServer.Addr, scheme, srv.Path)
+		err := srv.ListenAndServe(httpServer)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
 		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down server")
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := srv.Drain(drainCtx); err != nil {
+		log.Printf("Connections still open after %v were closed: %v", drainTimeout, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down http server: %v", err)
 	}
 }
 
-func main() {
-	http.HandleFunc("/ws", handleConnections)
-	log.Println("Server started on :8080")
-	err := http.ListenAndServe(":8080", nil)
+// validateAddr checks that addr is a host:port pair with a valid port. The
+// host may be empty to listen on all interfaces.
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
 	}
+	return nil
 }
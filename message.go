@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Message is a JSON object received from a client. Values are kept as raw
+// JSON so nested objects, numbers and arrays are echoed back unchanged.
+type Message map[string]json.RawMessage
+
+var replyReceived = json.RawMessage(`"Message received"`)
+
+// ReplyTo copies the request's "id" field, if any, onto reply so a client
+// can match the reply to the message it answers, and returns reply.
+func ReplyTo(request, reply Message) Message {
+	if id, ok := request["id"]; ok {
+		reply["id"] = id
+	}
+	return reply
+}
+
+// errNotObject is returned for a message that is valid JSON but not an
+// object, such as null, which decodes to a nil Message without an error.
+var errNotObject = errors.New("message is not a JSON object")
+
+// control is a client request handled by the server itself rather than by
+// the message handler:
+//
+//	{"type":"join","room":"lobby"}
+//	{"type":"leave","room":"lobby"}
+//	{"type":"subscribe","events":["price","trade"]}
+//	{"type":"unsubscribe","events":["trade"]}
+//	{"type":"subscribe","coalesce":false}
+type control struct {
+	Type   string   `json:"type"`
+	Room   string   `json:"room"`
+	Events []string `json:"events"`
+	// Coalesce, when present, opts the connection in or out of the hub's
+	// batching.
+	Coalesce *bool `json:"coalesce"`
+}
+
+// parseControl reports whether data is a control request.
+func parseControl(data []byte) (control, bool) {
+	var ctl control
+	if err := json.Unmarshal(data, &ctl); err != nil {
+		return ctl, false
+	}
+	switch ctl.Type {
+	case "join", "leave":
+		return ctl, ctl.Room != ""
+	case "subscribe":
+		return ctl, len(ctl.Events) > 0 || ctl.Coalesce != nil
+	case "unsubscribe":
+		return ctl, true
+	}
+	return ctl, false
+}
+
+// eventType returns the "type" field of a JSON message, or "" if it has
+// none.
+func eventType(data []byte) string {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(data, &envelope)
+	return envelope.Type
+}
+
+// errorReply is sent to a client whose message could not be processed but
+// which may carry on using the connection.
+type errorReply struct {
+	Error  string `json:"error"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (e errorReply) encode() []byte {
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// isDecodeError reports whether err came from malformed JSON rather than
+// from I/O, so the connection itself is still healthy. A message that is
+// not an object counts as malformed.
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) ||
+		errors.Is(err, errNotObject)
+}
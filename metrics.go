@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors updated by the server.
+type Metrics struct {
+	ConnectionsActive prometheus.Gauge
+	ConnectionsTotal  prometheus.Counter
+	MessagesReceived  prometheus.Counter
+	MessagesSent      prometheus.Counter
+	// ConnectionsCompressed counts the accepted connections that
+	// negotiated permessage-deflate.
+	ConnectionsCompressed prometheus.Counter
+	// Errors is labelled by kind, which matches the "event" field of the
+	// corresponding log entry.
+	Errors *prometheus.CounterVec
+
+	registry *prometheus.Registry
+}
+
+// NewMetrics creates the server collectors on a fresh registry that also
+// carries the standard Go runtime and process collectors.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		ConnectionsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "websocket_connections_active",
+			Help: "Number of currently open WebSocket connections.",
+		}),
+		ConnectionsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "websocket_connections_total",
+			Help: "Total number of WebSocket connections accepted.",
+		}),
+		ConnectionsCompressed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "websocket_connections_compressed_total",
+			Help: "Total number of WebSocket connections that negotiated permessage-deflate.",
+		}),
+		MessagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "websocket_messages_received_total",
+			Help: "Total number of messages read from clients.",
+		}),
+		MessagesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "websocket_messages_sent_total",
+			Help: "Total number of data frames written to clients.",
+		}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "websocket_errors_total",
+			Help: "Total number of connection errors by kind.",
+		}, []string{"kind"}),
+		registry: prometheus.NewRegistry(),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.ConnectionsActive,
+		m.ConnectionsTotal,
+		m.ConnectionsCompressed,
+		m.MessagesReceived,
+		m.MessagesSent,
+		m.Errors,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) error(kind string) {
+	m.Errors.WithLabelValues(kind).Inc()
+}
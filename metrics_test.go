@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForMetric scrapes m until its exposition contains line.
+func waitForMetric(t *testing.T, m *Metrics, line string) {
+	t.Helper()
+	srv := httptest.NewServer(m.Handler())
+	defer srv.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(body), "\n"+line+"\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics never reported %q:\n%s", line, body)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestActiveConnectionsGauge(t *testing.T) {
+	s := NewServer()
+	c := startServer(t, s).Dial("/ws")
+
+	waitForMetric(t, s.Metrics, "websocket_connections_active 1")
+	waitForMetric(t, s.Metrics, "websocket_connections_total 1")
+	c.Close()
+	waitForMetric(t, s.Metrics, "websocket_connections_active 0")
+}
@@ -0,0 +1,18 @@
+package main
+
+import "net/http"
+
+// Middleware wraps the WebSocket endpoint's HTTP handler. It runs before the
+// connection is upgraded, so it can inspect the request, add values to its
+// context for message handlers, or reject it with a normal HTTP response.
+type Middleware func(http.Handler) http.Handler
+
+// HTTPHandler returns the WebSocket endpoint wrapped in s.Middleware. The
+// first middleware is the outermost one and sees the request first.
+func (s *Server) HTTPHandler() http.Handler {
+	var h http.Handler = http.HandlerFunc(s.handleConnections)
+	for i := len(s.Middleware) - 1; i >= 0; i-- {
+		h = s.Middleware[i](h)
+	}
+	return h
+}
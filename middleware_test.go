@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+type requestIDKey struct{}
+
+// requestIDHandler replies with the request ID a middleware stored in the
+// upgrade request's context.
+type requestIDHandler struct{}
+
+func (requestIDHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return []byte(`"` + id + `"`), nil
+}
+
+func TestMiddlewareContextReachesHandler(t *testing.T) {
+	s := NewServer()
+	s.Handler = requestIDHandler{}
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+	s.Middleware = []Middleware{
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				record("outer")
+				ctx := context.WithValue(r.Context(), requestIDKey{}, "req-1")
+				next.ServeHTTP(w, r.WithContext(ctx))
+			})
+		},
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				record("inner")
+				next.ServeHTTP(w, r)
+			})
+		},
+	}
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{}`))
+	c.ExpectJSON(`"req-1"`)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Fatalf("middleware ran in order %v, want [outer inner]", order)
+	}
+}
+
+func TestMiddlewareRejectsBeforeUpgrade(t *testing.T) {
+	s := NewServer()
+	s.Middleware = []Middleware{
+		func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Tenant") == "" {
+					http.Error(w, "tenant required", http.StatusBadRequest)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		},
+	}
+	h := startServer(t, s)
+
+	if got := dialStatus(t, h.URL("/ws"), nil); got != http.StatusBadRequest {
+		t.Fatalf("request without tenant got %d, want 400", got)
+	}
+	if ids := s.Hub.ConnIDs(); len(ids) != 0 {
+		t.Fatalf("rejected request registered connections %v", ids)
+	}
+	h.DialHeader("/ws", http.Header{"X-Tenant": {"acme"}})
+}
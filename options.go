@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Option configures a Server in NewServer. Options run in order after the
+// defaults are set, so a later option overrides an earlier one. Fields
+// without an option can still be set on the returned Server.
+type Option func(*Server)
+
+// WithAddr sets the address ListenAndServe should listen on.
+func WithAddr(addr string) Option {
+	return func(s *Server) { s.Addr = addr }
+}
+
+// WithPath sets the HTTP path of the WebSocket endpoint.
+func WithPath(path string) Option {
+	return func(s *Server) { s.Path = path }
+}
+
+// WithReadTimeout sets ReadDeadline, how long to wait for the next message.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) { s.ReadDeadline = d }
+}
+
+// WithAllowedOrigins sets the Origin values that may open a socket.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) { s.AllowedOrigins = origins }
+}
+
+// WithLogger sets the structured logger for connection events.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) { s.Logger = l }
+}
+
+// WithMaxConnections caps how many connections may be open at once.
+func WithMaxConnections(n int) Option {
+	return func(s *Server) { s.MaxConnections = n }
+}
+
+// WithHandler replaces the text message handler.
+func WithHandler(h MessageHandler) Option {
+	return func(s *Server) { s.Handler = h }
+}
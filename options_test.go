@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewServerDefaults(t *testing.T) {
+	s := NewServer()
+	if s.Addr != ":8080" || s.Path != "/ws" {
+		t.Errorf("default address %q and path %q, want :8080 and /ws", s.Addr, s.Path)
+	}
+	if _, ok := s.Handler.(EchoHandler); !ok {
+		t.Errorf("default handler is %T, want EchoHandler", s.Handler)
+	}
+	if s.ReadDeadline != 60*time.Second || s.MaxConnections != 0 || s.AllowedOrigins != nil || s.Logger != nil {
+		t.Errorf("unexpected defaults: read deadline %v, max connections %d, origins %v, logger %v",
+			s.ReadDeadline, s.MaxConnections, s.AllowedOrigins, s.Logger)
+	}
+	if s.Hub == nil || s.Metrics == nil {
+		t.Error("NewServer left the hub or metrics unset")
+	}
+}
+
+func TestOptionsCompose(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := constHandler(`{}`)
+	s := NewServer(
+		WithAddr(":9000"),
+		WithPath("/socket"),
+		WithReadTimeout(time.Second),
+		WithAllowedOrigins("https://a.example", "https://b.example"),
+		WithLogger(logger),
+		WithMaxConnections(10),
+		WithHandler(handler),
+		WithMaxConnections(20),
+	)
+
+	if s.Addr != ":9000" || s.Path != "/socket" || s.ReadDeadline != time.Second {
+		t.Errorf("got address %q, path %q, read deadline %v", s.Addr, s.Path, s.ReadDeadline)
+	}
+	if want := []string{"https://a.example", "https://b.example"}; !reflect.DeepEqual(s.AllowedOrigins, want) {
+		t.Errorf("origins %v, want %v", s.AllowedOrigins, want)
+	}
+	if s.Logger != logger || s.Handler != handler {
+		t.Error("logger or handler option was not applied")
+	}
+	if s.MaxConnections != 20 {
+		t.Errorf("max connections %d, want the later option's 20", s.MaxConnections)
+	}
+	// Options leave the defaults they do not touch alone.
+	if s.WriteDeadline != 10*time.Second || s.SendBufferSize != 16 {
+		t.Errorf("write deadline %v and send buffer %d, want the defaults", s.WriteDeadline, s.SendBufferSize)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited ends a connection that broke the rate limit under
+// RateLimitClose.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimitPolicy decides what happens when a client sends messages faster
+// than the server's rate limit allows.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDelay holds back processing until the limiter admits the
+	// message.
+	RateLimitDelay RateLimitPolicy = iota
+	// RateLimitClose closes the connection with ClosePolicyViolation.
+	RateLimitClose
+)
+
+// admit applies the server's rate limit policy to one inbound message. An
+// error means the message must not be handled and the connection ends.
+func (s *Server) admit(ctx context.Context, c *Conn, limiter *rate.Limiter) error {
+	if limiter == nil {
+		return nil
+	}
+	if s.RateLimitPolicy == RateLimitClose {
+		if limiter.Allow() {
+			return nil
+		}
+		c.log.Warn("rate limit exceeded, closing connection", "event", "rate_limited")
+		c.metrics.error("rate_limited")
+		c.close(websocket.ClosePolicyViolation, "rate limit exceeded")
+		return ErrRateLimited
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		c.log.Warn("rate limit wait aborted", "event", "rate_limited", "err", err)
+		return err
+	}
+	return nil
+}
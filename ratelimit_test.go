@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRateLimitDelaysBurst(t *testing.T) {
+	s := NewServer()
+	s.RateLimit = 20
+	s.RateBurst = 2
+	c := startServer(t, s).Dial("/ws")
+
+	// Two messages fit the burst; the other four wait 50ms each.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		c.SendJSON(map[string]int{"n": i})
+	}
+	for i := 0; i < 6; i++ {
+		c.Receive()
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("6 messages handled in %v, faster than the limit allows", d)
+	}
+}
+
+func TestRateLimitClosesConnection(t *testing.T) {
+	s := NewServer()
+	s.RateLimit = 1
+	s.RateBurst = 2
+	s.RateLimitPolicy = RateLimitClose
+	c := startServer(t, s).Dial("/ws")
+
+	for i := 0; i < 5; i++ {
+		c.SendJSON(map[string]int{"n": i})
+	}
+	c.ExpectClose(websocket.ClosePolicyViolation)
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// retryAfter is the Retry-After value, in seconds, sent when the server is
+// at MaxConnections.
+const retryAfter = "5"
+
+// forceCloseWait bounds how long Drain waits for close frames to reach the
+// connections still open at its deadline.
+const forceCloseWait = time.Second
+
+// Server tracks every open WebSocket so that they can be closed with a
+// proper close frame when the process shuts down.
+type Server struct {
+	// Addr is the listen address ListenAndServe falls back to, and Path
+	// the HTTP path the endpoint is meant to be mounted at. They default
+	// to ":8080" and "/ws".
+	Addr string
+	Path string
+	// Handler processes inbound text messages and BinaryHandler inbound
+	// binary messages. Replies are sent with the type of the message they
+	// answer. They default to EchoHandler and BinaryEchoHandler.
+	Handler       MessageHandler
+	BinaryHandler MessageHandler
+	// ReadDeadline bounds how long the server waits for the next message
+	// and WriteDeadline how long a single write may take. A write that
+	// misses its deadline, typically to a client that stopped reading,
+	// means the connection is dead, and it is torn down rather than
+	// retried. Zero disables the corresponding deadline.
+	ReadDeadline  time.Duration
+	WriteDeadline time.Duration
+	// PingInterval is how often a ping is sent to keep idle connections
+	// alive; zero disables keepalive. With keepalive on, a connection is
+	// closed when neither a message nor a pong arrives within
+	// PingInterval+PongWait, i.e. PongWait after a ping goes unanswered,
+	// even if ReadDeadline is longer or zero.
+	PingInterval time.Duration
+	PongWait     time.Duration
+	// HandshakeTimeout bounds the opening handshake: ListenAndServe uses
+	// it as the http.Server's ReadHeaderTimeout, unless one is already
+	// set, so clients that trickle in request headers are cut off, and the
+	// upgrader aborts if the upgrade response cannot be written in time.
+	// Zero disables both.
+	HandshakeTimeout time.Duration
+	// Subprotocols lists the Sec-WebSocket-Protocol values the server
+	// accepts, in order of preference. A connection that negotiates one
+	// with an entry in SubprotocolHandlers has all of its messages routed
+	// there; every other connection uses Handler and BinaryHandler.
+	Subprotocols        []string
+	SubprotocolHandlers map[string]MessageHandler
+	// SendBufferSize is how many outbound frames may queue per
+	// connection. Broadcasts to a connection whose queue is full are
+	// dropped, and a connection whose queue stays full for SendTimeout is
+	// disconnected, so a slow client never blocks the hub.
+	SendBufferSize int
+	SendTimeout    time.Duration
+	// MaxDecodeFailures is how many malformed JSON messages in a row a
+	// client may send before it is disconnected. Each one is answered with
+	// an {"error":"invalid json"} reply and the connection stays open.
+	MaxDecodeFailures int
+	// Validate, when set, vets every text message bound for Handler once
+	// it has decoded as JSON. Rejected messages are answered with an
+	// error reply and not handled. Subprotocol handlers are not
+	// validated, as their messages need not be JSON.
+	Validate Validator
+	// IdleTimeout closes connections, with CloseNormalClosure, that have
+	// not sent an application message for that long. Unlike ReadDeadline
+	// it is not extended by pongs. Zero disables it.
+	IdleTimeout time.Duration
+	// MaxMessageSize is the largest inbound message, in bytes, that will
+	// be read. Larger messages close the connection with
+	// CloseMessageTooBig. Zero means no limit.
+	MaxMessageSize int64
+	// RateLimit caps inbound messages per second on each connection,
+	// allowing bursts of up to RateBurst. Zero disables rate limiting.
+	// RateLimitPolicy picks between delaying and disconnecting clients
+	// that go over the limit.
+	RateLimit       rate.Limit
+	RateBurst       int
+	RateLimitPolicy RateLimitPolicy
+	// ReadBufferSize and WriteBufferSize size the I/O buffers of each
+	// connection, in bytes; zero uses gorilla's 4096 byte default. The
+	// buffers are allocated per connection, so larger values trade memory
+	// for fewer syscalls on big messages, while many small messages fit
+	// comfortably in small buffers. Messages larger than a buffer still
+	// work; they are just read or written in several chunks.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// EnableCompression negotiates permessage-deflate with clients that
+	// support it, trading CPU for bandwidth. Outbound frames smaller than
+	// CompressionThreshold bytes are sent uncompressed, since deflating
+	// tiny frames costs more CPU than it saves. CompressionLevel is a
+	// compress/flate level; zero keeps gorilla's default.
+	EnableCompression    bool
+	CompressionThreshold int
+	CompressionLevel     int
+	// Hub receives every connection, so messages can be broadcast to all
+	// connected clients.
+	Hub *Hub
+	// AllowedOrigins lists the Origin header values that may open a
+	// socket, e.g. "https://example.com". "*" allows any origin and is
+	// meant for development. When empty only same-host origins are
+	// accepted. Requests without an Origin header come from non-browser
+	// clients and are always allowed.
+	AllowedOrigins []string
+	// Middleware wraps the endpoint returned by HTTPHandler. Values it
+	// stores in the request context are visible to message handlers.
+	Middleware []Middleware
+	// Interceptors wrap whichever handler a message is routed to. They
+	// run after control messages and Validate have been dealt with.
+	Interceptors []Interceptor
+	// MaxConnections caps how many connections may be open at once.
+	// Upgrades beyond it are refused with 503 Service Unavailable and a
+	// Retry-After header. Zero means no limit.
+	MaxConnections int
+	// MaxConnectionsPerIP caps the connections a single client IP may
+	// have open; upgrades beyond it are refused with 429 Too Many
+	// Requests. Zero means no limit. TrustProxy takes the IP from the
+	// X-Forwarded-For header instead of the socket address; set it only
+	// when the server sits behind a proxy that adds that header, or
+	// clients could claim any IP.
+	MaxConnectionsPerIP int
+	TrustProxy          bool
+	// Authenticate, when set, must accept a request before it is
+	// upgraded. The user ID it returns is recorded on the connection.
+	Authenticate Authenticator
+	// AdminAuthenticate must accept every request to the admin endpoints.
+	// It is separate from Authenticate so that ordinary users cannot list
+	// or kick connections. When nil the admin endpoints answer 403.
+	AdminAuthenticate Authenticator
+	// OnConnect runs once a connection is open and registered.
+	// OnDisconnect runs exactly once when it ends, however it ends, with
+	// the error that ended it: a *websocket.CloseError for client closes,
+	// or the read, write, handler or panic error otherwise.
+	OnConnect    func(c *Conn)
+	OnDisconnect func(c *Conn, err error)
+	// Logger receives structured connection events. When nil the
+	// slog default logger is used, which writes text to stderr.
+	Logger *slog.Logger
+	// Metrics records connection and message counters; serve them with
+	// Metrics.Handler.
+	Metrics *Metrics
+	// CertFile and KeyFile enable TLS (wss://) in ListenAndServe. When
+	// either is empty the server falls back to plaintext ws://. TLSConfig
+	// optionally tunes the TLS listener, e.g. its minimum version.
+	CertFile  string
+	KeyFile   string
+	TLSConfig *tls.Config
+	// DrainNotice, when set, is sent to every client as Drain begins, e.g.
+	// {"type":"server_draining"}, so they can reconnect elsewhere. It skips
+	// the hub, so subscriptions and coalescing do not apply to it.
+	DrainNotice []byte
+
+	lastID       atomic.Uint64
+	active       atomic.Int64
+	shuttingDown atomic.Bool
+	mu           sync.Mutex
+	conns        map[*Conn]struct{}
+	ipMu         sync.Mutex
+	perIP        map[string]int
+	// open counts tracked connections until their handlers return, which
+	// can be after Shutdown has dropped them from conns.
+	open sync.WaitGroup
+}
+
+// NewServer returns a Server with the defaults below, then applies opts.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		Addr:                 ":8080",
+		Path:                 "/ws",
+		Handler:              EchoHandler{},
+		BinaryHandler:        BinaryEchoHandler{},
+		ReadDeadline:         60 * time.Second,
+		WriteDeadline:        10 * time.Second,
+		PingInterval:         30 * time.Second,
+		PongWait:             10 * time.Second,
+		HandshakeTimeout:     10 * time.Second,
+		SendBufferSize:       16,
+		SendTimeout:          5 * time.Second,
+		MaxMessageSize:       512 << 10,
+		MaxDecodeFailures:    3,
+		CompressionThreshold: 256,
+		Hub:                  NewHub(),
+		Metrics:              NewMetrics(),
+		conns:                make(map[*Conn]struct{}),
+		perIP:                make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// track records c as open. It reports false once shutdown has begun, in
+// which case the caller must close c itself.
+func (s *Server) track(c *Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown.Load() {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.open.Add(1)
+	return true
+}
+
+// untrack undoes a successful track once the connection's handler is done.
+func (s *Server) untrack(c *Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	s.open.Done()
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown.Load() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// Reserve a slot before upgrading; the deferred release covers every
+	// way out of this handler.
+	n := s.active.Add(1)
+	defer s.active.Add(-1)
+	if s.MaxConnections > 0 && n > int64(s.MaxConnections) {
+		s.logger().Warn("connection limit reached", "event", "max_connections",
+			"remote_addr", r.RemoteAddr, "limit", s.MaxConnections)
+		s.Metrics.error("max_connections")
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	if s.MaxConnectionsPerIP > 0 {
+		ip := s.clientIP(r)
+		if !s.acquireIP(ip) {
+			s.logger().Warn("per-IP connection limit reached", "event", "ip_limit",
+				"remote_addr", r.RemoteAddr, "ip", ip, "limit", s.MaxConnectionsPerIP)
+			s.Metrics.error("ip_limit")
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "too many connections from this address", http.StatusTooManyRequests)
+			return
+		}
+		defer s.releaseIP(ip)
+	}
+
+	var userID string
+	if s.Authenticate != nil {
+		var err error
+		userID, err = s.Authenticate(r)
+		if err != nil {
+			s.logger().Warn("authentication failed", "event", "auth",
+				"remote_addr", r.RemoteAddr, "err", err)
+			s.Metrics.error("auth")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	ws, err := s.upgrader().Upgrade(w, r, nil)
+	if err != nil {
+		s.logger().Warn("upgrade failed", "event", "upgrade",
+			"remote_addr", r.RemoteAddr, "err", err)
+		s.Metrics.error("upgrade")
+		return
+	}
+	s.Metrics.ConnectionsTotal.Inc()
+	compressed := s.EnableCompression && offersCompression(r)
+	if compressed {
+		s.Metrics.ConnectionsCompressed.Inc()
+	}
+	s.Metrics.ConnectionsActive.Inc()
+	defer s.Metrics.ConnectionsActive.Dec()
+	defer ws.Close()
+	ws.SetReadLimit(s.MaxMessageSize)
+	if s.EnableCompression && s.CompressionLevel != 0 {
+		if err := ws.SetCompressionLevel(s.CompressionLevel); err != nil {
+			s.logger().Warn("invalid compression level", "event", "compression",
+				"level", s.CompressionLevel, "err", err)
+		}
+	}
+
+	id := strconv.FormatUint(s.lastID.Add(1), 10)
+	logger := s.logger().With("conn_id", id, "remote_addr", r.RemoteAddr)
+	if userID != "" {
+		logger = logger.With("user_id", userID)
+	}
+	if p := ws.Subprotocol(); p != "" {
+		logger = logger.With("subprotocol", p)
+	}
+	if compressed {
+		logger = logger.With("compression", "permessage-deflate")
+	}
+	stats := newConnStats()
+	c := &Conn{
+		id:          id,
+		userID:      userID,
+		subprotocol: ws.Subprotocol(),
+		remoteAddr:  r.RemoteAddr,
+		compressed:  compressed,
+		ws:          ws,
+		log:         logger,
+		metrics:     s.Metrics,
+		stats:       stats,
+		writer: newConnWriter(ws, writerConfig{
+			writeWait:            s.WriteDeadline,
+			bufferSize:           s.SendBufferSize,
+			sendTimeout:          s.SendTimeout,
+			compressionThreshold: s.CompressionThreshold,
+			log:                  logger,
+			metrics:              s.Metrics,
+			stats:                stats,
+		}),
+	}
+	defer c.writer.Close()
+	c.touch()
+	if s.PingInterval > 0 {
+		go c.writer.keepalive(s.PingInterval)
+	}
+	if s.IdleTimeout > 0 {
+		go s.closeWhenIdle(c)
+	}
+	if !s.track(c) {
+		c.close(websocket.CloseGoingAway, "server shutting down")
+		return
+	}
+	defer s.untrack(c)
+	s.Hub.Register(c)
+	defer s.Hub.Unregister(c)
+	c.log.Info("connection opened", "event", "connect")
+	defer c.log.Info("connection closed", "event", "disconnect")
+
+	// Every way out of the connection, including a panic, passes through
+	// this single deferred call, so OnDisconnect fires exactly once.
+	var cause error
+	defer func() {
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(c, cause)
+		}
+	}()
+	defer func() {
+		// A panicking handler must only take down its own connection.
+		if v := recover(); v != nil {
+			c.log.Error("panic in connection handler", "event", "panic",
+				"panic", v, "stack", string(debug.Stack()))
+			s.Metrics.error("panic")
+			c.close(websocket.CloseInternalServerErr, "internal error")
+			cause = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	if s.OnConnect != nil {
+		s.OnConnect(c)
+	}
+
+	ctx := context.WithValue(r.Context(), connIDKey{}, id)
+	ctx = context.WithValue(ctx, userIDKey{}, userID)
+	cause = s.readLoop(ctx, c)
+}
+
+// readLoop reads and handles messages until the connection fails, returning
+// the error that ended it. Messages are read on a separate goroutine so that
+// a client going away cancels ctx while a handler is still running.
+func (s *Server) readLoop(ctx context.Context, c *Conn) error {
+	var limiter *rate.Limiter
+	if s.RateLimit > 0 {
+		limiter = rate.NewLimiter(s.RateLimit, max(s.RateBurst, 1))
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	frames := make(chan frame)
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.readFrames(c, cancel, frames, stop)
+
+	for {
+		f := <-frames
+		if f.err != nil {
+			return s.readFailed(c, f.err)
+		}
+		c.touch()
+		c.stats.received(len(f.data))
+		s.Metrics.MessagesReceived.Inc()
+		err := s.admit(ctx, c, limiter)
+		if err == nil {
+			err = s.handleMessage(ctx, c, f.messageType, f.data)
+		}
+		if err == nil {
+			continue
+		}
+		if cause := context.Cause(ctx); cause != ctx.Err() {
+			// Reading failed while the message was in flight; that failure,
+			// not the cancellation it caused, ended the connection.
+			return s.readFailed(c, cause)
+		}
+		return err
+	}
+}
+
+// frame is a message read from the client, or the error that ended reading.
+type frame struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// readFrames feeds readLoop until a read fails. It then cancels the
+// connection's context, with the read error as the cause, before reporting
+// the error, so the handler of an earlier message learns at once that the
+// client is gone.
+func (s *Server) readFrames(c *Conn, cancel context.CancelCauseFunc, frames chan<- frame, stop <-chan struct{}) {
+	ws := c.ws
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(deadline(s.PingInterval + s.PongWait))
+	})
+	ws.SetCloseHandler(func(code int, text string) error {
+		// Complete the close handshake by echoing the client's code. The
+		// echo is queued behind pending writes instead of being written
+		// directly as gorilla's default handler does.
+		c.writer.Send(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+		return nil
+	})
+	for {
+		ws.SetReadDeadline(deadline(s.readWait()))
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			cancel(err)
+		}
+		select {
+		case frames <- frame{messageType: messageType, data: data, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readWait is how long a read may wait for a message. With keepalive on it
+// is capped at PingInterval+PongWait, so a peer that stops answering pings
+// is dropped from the first ping on. A pong restarts the full grace period.
+func (s *Server) readWait() time.Duration {
+	if s.PingInterval <= 0 {
+		return s.ReadDeadline
+	}
+	grace := s.PingInterval + s.PongWait
+	if s.ReadDeadline <= 0 || s.ReadDeadline > grace {
+		return grace
+	}
+	return s.ReadDeadline
+}
+
+// readFailed logs the error that ended reading, closing the connection
+// where the client still needs to be told why, and returns it.
+func (s *Server) readFailed(c *Conn, err error) error {
+	if werr := c.writer.Err(); werr != nil && errors.Is(err, net.ErrClosed) {
+		// The writer closed the socket under the read and has already
+		// logged why; that is the real cause.
+		return werr
+	}
+	switch {
+	case isTimeout(err):
+		c.log.Info("read deadline exceeded, closing connection",
+			"event", "read_timeout", "err", err)
+		s.Metrics.error("read_timeout")
+		c.close(websocket.CloseGoingAway, "read timeout")
+	case errors.Is(err, websocket.ErrReadLimit):
+		// gorilla has already sent the CloseMessageTooBig frame.
+		c.log.Warn("message exceeds read limit, closing connection",
+			"event", "message_too_big", "limit", s.MaxMessageSize)
+		s.Metrics.error("message_too_big")
+	default:
+		logReadError(c, err)
+	}
+	return err
+}
+
+// closeWhenIdle closes c once it has gone IdleTimeout without sending a
+// message. It returns when the connection's writer stops.
+func (s *Server) closeWhenIdle(c *Conn) {
+	timer := time.NewTimer(s.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if idle := c.idleFor(); idle < s.IdleTimeout {
+				timer.Reset(s.IdleTimeout - idle)
+				continue
+			}
+			c.log.Info("connection idle, closing", "event", "idle_timeout",
+				"timeout", s.IdleTimeout)
+			c.close(websocket.CloseNormalClosure, "idle timeout")
+			return
+		case <-c.writer.done:
+			return
+		case <-c.writer.exited:
+			return
+		}
+	}
+}
+
+// handleMessage dispatches one inbound frame to the handler for the
+// connection's subprotocol, or else for the frame's type, and queues the
+// reply as a frame of the same type. An error ends the connection.
+func (s *Server) handleMessage(ctx context.Context, c *Conn, messageType int, data []byte) error {
+	handler, ok := s.SubprotocolHandlers[c.subprotocol]
+	switch {
+	case ok && c.subprotocol != "":
+	case messageType == websocket.BinaryMessage:
+		handler = s.BinaryHandler
+	default:
+		if ctl, ok := parseControl(data); ok {
+			s.handleControl(c, ctl)
+			return nil
+		}
+		if s.Validate != nil {
+			var msg json.RawMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return s.rejectMalformed(c, err)
+			}
+			if err := s.Validate(msg); err != nil {
+				return s.rejectInvalid(c, err)
+			}
+		}
+		handler = s.Handler
+	}
+	reply, err := s.intercept(handler).Handle(ctx, data)
+	if isDecodeError(err) {
+		return s.rejectMalformed(c, err)
+	}
+	c.decodeFailures = 0
+	if err != nil && ctx.Err() != nil {
+		// The client is gone; readLoop reports why.
+		return err
+	}
+	if errors.Is(err, ErrRejected) {
+		return s.rejectMessage(c, err)
+	}
+	if err != nil {
+		c.log.Error("handler failed", "event", "handler_error", "err", err)
+		s.Metrics.error("handler_error")
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+	return c.writer.Send(messageType, reply)
+}
+
+func (s *Server) handleControl(c *Conn, ctl control) {
+	switch ctl.Type {
+	case "join":
+		s.Hub.Join(c, ctl.Room)
+	case "leave":
+		s.Hub.Leave(c, ctl.Room)
+	case "subscribe":
+		if len(ctl.Events) > 0 {
+			s.Hub.Subscribe(c, ctl.Events)
+		}
+		if ctl.Coalesce != nil {
+			s.Hub.SetCoalescing(c, *ctl.Coalesce)
+		}
+	case "unsubscribe":
+		s.Hub.Unsubscribe(c, ctl.Events)
+	}
+}
+
+// rejectInvalid answers a message that failed validation with an error
+// reply. Unlike malformed JSON it does not count towards MaxDecodeFailures.
+func (s *Server) rejectInvalid(c *Conn, err error) error {
+	c.log.Warn("invalid message", "event", "validation_error", "err", err)
+	s.Metrics.error("validation_error")
+	reply := errorReply{Error: "invalid message", Detail: err.Error()}
+	return c.writer.Send(websocket.TextMessage, reply.encode())
+}
+
+// rejectMessage answers a message that an interceptor or handler rejected
+// with ErrRejected. The connection stays open.
+func (s *Server) rejectMessage(c *Conn, err error) error {
+	c.log.Warn("message rejected", "event", "rejected", "err", err)
+	s.Metrics.error("rejected")
+	reply := errorReply{Error: "message rejected", Detail: err.Error()}
+	return c.writer.Send(websocket.TextMessage, reply.encode())
+}
+
+// rejectMalformed answers a message that failed to decode with an error
+// reply, and ends the connection once MaxDecodeFailures is reached.
+func (s *Server) rejectMalformed(c *Conn, err error) error {
+	c.decodeFailures++
+	c.log.Warn("invalid json", "event", "decode_error",
+		"failures", c.decodeFailures, "err", err)
+	s.Metrics.error("decode_error")
+	if c.decodeFailures >= s.MaxDecodeFailures {
+		c.close(websocket.CloseUnsupportedData, "too many invalid messages")
+		return err
+	}
+	reply := errorReply{Error: "invalid json", Detail: err.Error()}
+	return c.writer.Send(websocket.TextMessage, reply.encode())
+}
+
+// TLSEnabled reports whether ListenAndServe will serve wss://.
+func (s *Server) TLSEnabled() bool {
+	return s.CertFile != "" && s.KeyFile != ""
+}
+
+// ListenAndServe runs hs with TLS when a certificate is configured and in
+// plaintext otherwise. hs gets Addr as its address and HandshakeTimeout as
+// its ReadHeaderTimeout when it has none.
+func (s *Server) ListenAndServe(hs *http.Server) error {
+	if hs.Addr == "" {
+		hs.Addr = s.Addr
+	}
+	if hs.ReadHeaderTimeout == 0 {
+		hs.ReadHeaderTimeout = s.HandshakeTimeout
+	}
+	if !s.TLSEnabled() {
+		return hs.ListenAndServe()
+	}
+	if s.TLSConfig != nil {
+		hs.TLSConfig = s.TLSConfig
+	}
+	return hs.ListenAndServeTLS(s.CertFile, s.KeyFile)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func (s *Server) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    s.ReadBufferSize,
+		WriteBufferSize:   s.WriteBufferSize,
+		HandshakeTimeout:  s.HandshakeTimeout,
+		EnableCompression: s.EnableCompression,
+		Subprotocols:      s.Subprotocols,
+		CheckOrigin:       s.checkOrigin,
+	}
+}
+
+// offersCompression reports whether the client offered permessage-deflate
+// in Sec-WebSocket-Extensions. gorilla does not expose the outcome of the
+// negotiation, but it accepts the extension whenever it is offered and
+// compression is enabled, so the offer is what decides it.
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Shutdown marks the server as not ready, rejects new upgrades, and sends
+// a CloseGoingAway frame to every open connection before closing it.
+// Connections whose queued messages have not been written by ctx's deadline
+// get the close frame ahead of them, and ctx's error is returned.
+// http.Server.Shutdown does not touch hijacked connections, so this must be
+// called alongside it, and before it so /readyz can report the drain.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown.Store(true)
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+		delete(s.conns, c)
+	}
+	s.mu.Unlock()
+
+	// Connections are closed in parallel so that one client that stopped
+	// reading cannot hold up the close frames of the others.
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			if err := c.closeContext(ctx, websocket.CloseGoingAway, "server shutting down"); err != nil {
+				c.log.Warn("sending close frame failed", "event", "shutdown", "err", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	s.Hub.Stop()
+	return ctx.Err()
+}
+
+// Drain is a gentler Shutdown for rolling deploys. It rejects new upgrades,
+// sends DrainNotice if set, and waits for the open connections to end
+// on their own. Whatever is still open when ctx expires is closed as by
+// Shutdown, and ctx's error is returned.
+func (s *Server) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown.Store(true)
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	s.logger().Info("draining connections", "event", "drain", "connections", len(conns))
+	if s.DrainNotice != nil {
+		for _, c := range conns {
+			c.writer.TrySend(websocket.TextMessage, s.DrainNotice)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.open.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.mu.Lock()
+		remaining := len(s.conns)
+		s.mu.Unlock()
+		s.logger().Warn("drain deadline reached, closing remaining connections",
+			"event", "drain", "connections", remaining)
+		// ctx is spent, so the stragglers get a short grace period of
+		// their own to receive the close frame.
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), forceCloseWait)
+		defer cancel()
+		s.Shutdown(closeCtx)
+		return ctx.Err()
+	}
+	return s.Shutdown(ctx)
+}
+
+// logReadError logs the error that ended a read loop. Clean closes by the
+// client, or by the server tearing the socket down, are routine and logged
+// quietly; anything else is an error.
+func logReadError(c *Conn, err error) {
+	var closeErr *websocket.CloseError
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway):
+		errors.As(err, &closeErr)
+		c.log.Info("client closed connection", "event", "close", "code", closeErr.Code)
+	case errors.Is(err, net.ErrClosed):
+		c.log.Debug("connection closed by server", "event", "close")
+	case errors.As(err, &closeErr):
+		c.log.Error("connection closed unexpectedly", "event", "abnormal_close",
+			"code", closeErr.Code, "err", err)
+		c.metrics.error("abnormal_close")
+	default:
+		c.log.Error("read failed", "event", "read_error", "err", err)
+		c.metrics.error("read_error")
+	}
+}
+
+// deadline returns the absolute deadline d from now, or the zero time (no
+// deadline) when d is not positive.
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Websocket/client"
+	"Websocket/testutil"
+	"github.com/gorilla/websocket"
+)
+
+// startServer serves s's WebSocket endpoint on a test harness and shuts s
+// down when the test ends.
+func startServer(t *testing.T, s *Server) *testutil.Harness {
+	t.Helper()
+	h := testutil.Start(t, s.HTTPHandler())
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return h
+}
+
+// waitForConns waits until the hub has n registered connections.
+func waitForConns(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ids := s.Hub.ConnIDs()
+		if len(ids) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has connections %v, want %d", ids, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// logBuffer collects the JSON log lines of a server for inspection.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// entries returns the records logged so far, optionally only those with
+// the given event.
+func (b *logBuffer) entries(t *testing.T, event string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e map[string]any
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatalf("log line %s: %v", line, err)
+		}
+		if event == "" || e["event"] == event {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// captureLogs makes s log to the returned buffer.
+func captureLogs(s *Server) *logBuffer {
+	b := &logBuffer{}
+	s.Logger = slog.New(slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return b
+}
+
+func TestUpgradeFailureKeepsServing(t *testing.T) {
+	h := startServer(t, NewServer())
+
+	resp, err := http.Get(h.Server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET got %s, want 400", resp.Status)
+	}
+
+	c := h.Dial("/ws")
+	c.SendJSON(map[string]string{"hello": "world"})
+	c.ExpectJSON(`{"hello":"world","reply":"Message received"}`)
+}
+
+func TestShutdownSendsGoingAway(t *testing.T) {
+	s := NewServer()
+	h := startServer(t, s)
+	a, b := h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a.ExpectClose(websocket.CloseGoingAway)
+	b.ExpectClose(websocket.CloseGoingAway)
+}
+
+// queueFull reports whether any connection of s has a full send queue.
+func queueFull(s *Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		if len(c.writer.send) == cap(c.writer.send) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestShutdownIsBoundedByContext(t *testing.T) {
+	s := NewServer()
+	s.SendTimeout = time.Minute
+	s.WriteDeadline = 0
+	h := startServer(t, s)
+	stalled := h.Dial("/ws") // never reads
+	defer stalled.Close()
+	healthy := h.Dial("/ws")
+	waitForConns(t, s, 2)
+	go func() {
+		for {
+			if _, _, err := healthy.Conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Frames far larger than the socket buffers block the stalled client's
+	// writer, so its queue fills and a queued close frame cannot get in.
+	payload := []byte(`"` + strings.Repeat("x", 64<<10) + `"`)
+	timeout := time.After(2 * time.Second)
+	for !queueFull(s) {
+		s.Hub.Broadcast(payload)
+		select {
+		case <-timeout:
+			t.Fatal("stalled client's queue never filled")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	const wait = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if d := time.Since(start); d > wait+200*time.Millisecond {
+			t.Fatalf("Shutdown returned after %v, past its %v deadline", d, wait)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown blocked on the stalled client")
+	}
+	if ids := s.Hub.ConnIDs(); len(ids) != 0 {
+		t.Fatalf("connections %v left after Shutdown", ids)
+	}
+}
+
+func TestReadDeadlineClosesSilentConnection(t *testing.T) {
+	s := NewServer()
+	s.ReadDeadline = 100 * time.Millisecond
+	c := startServer(t, s).Dial("/ws")
+
+	start := time.Now()
+	c.ExpectClose(websocket.CloseGoingAway)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("closed after %v, before the read deadline", d)
+	}
+}
+
+func TestUnansweredPingsCloseConnection(t *testing.T) {
+	s := NewServer()
+	s.ReadDeadline = 0
+	s.PingInterval = 50 * time.Millisecond
+	s.PongWait = 50 * time.Millisecond
+	causes := make(chan error, 2)
+	s.OnDisconnect = func(c *Conn, err error) { causes <- err }
+	h := startServer(t, s)
+
+	// gorilla only answers pings while reading, so the first client never
+	// sends a pong and the second always does.
+	h.Dial("/ws")
+	waitForConns(t, s, 1)
+	answering := h.Dial("/ws")
+	go func() {
+		for {
+			if _, _, err := answering.Conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-causes:
+		if !isTimeout(err) {
+			t.Fatalf("disconnect cause %v, want a read timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection without pongs was not closed")
+	}
+	time.Sleep(4 * s.PingInterval)
+	if ids := s.Hub.ConnIDs(); len(ids) != 1 {
+		t.Fatalf("connections %v, want only the one answering pings", ids)
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	s := NewServer()
+	s.AllowedOrigins = []string{"https://app.example.com"}
+	h := startServer(t, s)
+
+	for _, tc := range []struct {
+		origin string
+		want   int
+	}{
+		{"https://app.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"", http.StatusSwitchingProtocols},
+	} {
+		header := http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(h.URL("/ws"), header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("origin %q: %v", tc.origin, err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("origin %q got %s, want %d", tc.origin, resp.Status, tc.want)
+		}
+	}
+}
+
+// connIDHandler replies with the connection ID found in the handler context.
+type connIDHandler struct{}
+
+func (connIDHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	id, _ := ConnIDFromContext(ctx)
+	return json.Marshal(map[string]string{"id": id})
+}
+
+func TestConnectionIDs(t *testing.T) {
+	s := NewServer()
+	s.Handler = connIDHandler{}
+	logs := captureLogs(s)
+	h := startServer(t, s)
+	a, b := h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 2)
+
+	var ids []string
+	for _, c := range []*testutil.Client{a, b} {
+		var reply struct{ ID string }
+		c.Send([]byte(`{}`))
+		c.ReceiveJSON(&reply)
+		if reply.ID == "" {
+			t.Fatal("handler context has no connection ID")
+		}
+		ids = append(ids, reply.ID)
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("both connections have ID %q", ids[0])
+	}
+
+	logged := make(map[any]bool)
+	for _, e := range logs.entries(t, "connect") {
+		logged[e["conn_id"]] = true
+	}
+	for _, id := range ids {
+		if !logged[id] {
+			t.Errorf("connection %s missing from the connect logs", id)
+		}
+	}
+}
+
+func TestOversizedMessageClosesConnection(t *testing.T) {
+	s := NewServer()
+	s.MaxMessageSize = 1024
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send(bytes.Repeat([]byte("x"), 2048))
+	c.ExpectClose(websocket.CloseMessageTooBig)
+}
+
+// waitForLog waits until s has logged a record with event and returns it.
+func waitForLog(t *testing.T, logs *logBuffer, event string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if e := logs.entries(t, event); len(e) > 0 {
+			return e[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %q log record in %v", event, logs.entries(t, ""))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCleanCloseLogsInfo(t *testing.T) {
+	s := NewServer()
+	logs := captureLogs(s)
+	c := startServer(t, s).Dial("/ws")
+	waitForConns(t, s, 1)
+
+	c.Close()
+	waitForLog(t, logs, "disconnect")
+	if e := logs.entries(t, "close"); len(e) != 1 || e[0]["level"] != "INFO" {
+		t.Fatalf("clean close logged as %v, want one INFO close record", e)
+	}
+	if e := logs.entries(t, "abnormal_close"); len(e) != 0 {
+		t.Fatalf("clean close logged as abnormal: %v", e)
+	}
+}
+
+func TestDroppedConnectionLogsError(t *testing.T) {
+	s := NewServer()
+	logs := captureLogs(s)
+	c := startServer(t, s).Dial("/ws")
+	waitForConns(t, s, 1)
+
+	c.Conn.NetConn().Close()
+	waitForLog(t, logs, "disconnect")
+	e := logs.entries(t, "abnormal_close")
+	if len(e) != 1 || e[0]["level"] != "ERROR" {
+		t.Fatalf("dropped connection logged as %v, want one ERROR abnormal_close record",
+			logs.entries(t, ""))
+	}
+	if e := logs.entries(t, "close"); len(e) != 0 {
+		t.Fatalf("dropped connection logged as a clean close: %v", e)
+	}
+}
+
+// panicHandler panics on {"panic":true} and echoes everything else.
+type panicHandler struct{}
+
+func (panicHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	if bytes.Contains(msg, []byte(`"panic"`)) {
+		panic("handler exploded")
+	}
+	return EchoHandler{}.Handle(ctx, msg)
+}
+
+func TestHandlerPanicClosesOnlyItsConnection(t *testing.T) {
+	s := NewServer()
+	s.Handler = panicHandler{}
+	logs := captureLogs(s)
+	h := startServer(t, s)
+	bad, good := h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 2)
+
+	bad.SendJSON(map[string]bool{"panic": true})
+	bad.ExpectClose(websocket.CloseInternalServerErr)
+	waitForConns(t, s, 1)
+	if e := waitForLog(t, logs, "panic"); e["stack"] == nil {
+		t.Errorf("panic logged without a stack trace: %v", e)
+	}
+
+	good.SendJSON(map[string]string{"hello": "world"})
+	good.ExpectJSON(`{"hello":"world","reply":"Message received"}`)
+	h.Dial("/ws")
+	waitForConns(t, s, 2)
+}
+
+func TestBinaryEchoKeepsFrameType(t *testing.T) {
+	c := startServer(t, NewServer()).Dial("/ws")
+
+	payload := []byte{0x00, 0xff, 0x10, 0x80}
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatal(err)
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	typ, got, err := c.Conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage || !bytes.Equal(got, payload) {
+		t.Fatalf("got frame type %d payload %x, want binary %x", typ, got, payload)
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	s := NewServer()
+	s.EnableCompression = true
+	h := startServer(t, s)
+
+	d := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := d.Dial(h.URL("/ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("compression not negotiated, extensions %q", ext)
+	}
+
+	big := strings.Repeat("all work and no play ", 10000)
+	if err := conn.WriteJSON(map[string]string{"text": big}); err != nil {
+		t.Fatal(err)
+	}
+	var reply map[string]string
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply["text"] != big {
+		t.Fatalf("payload of %d bytes came back as %d bytes", len(big), len(reply["text"]))
+	}
+}
+
+// constHandler replies to every message with itself.
+type constHandler string
+
+func (h constHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	return []byte(h), nil
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	s := NewServer()
+	s.Subprotocols = []string{"v2.json"}
+	s.SubprotocolHandlers = map[string]MessageHandler{"v2.json": constHandler(`{"v":2}`)}
+	h := startServer(t, s)
+
+	for _, tc := range []struct {
+		requested, negotiated, reply string
+	}{
+		{"v2.json", "v2.json", `{"v":2}`},
+		{"v9.json", "", `{"hello":"world","reply":"Message received"}`},
+	} {
+		d := websocket.Dialer{Subprotocols: []string{tc.requested}}
+		conn, resp, err := d.Dial(h.URL("/ws"), nil)
+		if err != nil {
+			t.Fatalf("requesting %s: %v", tc.requested, err)
+		}
+		if got := resp.Header.Get("Sec-Websocket-Protocol"); got != tc.negotiated {
+			t.Errorf("requesting %s negotiated %q, want %q", tc.requested, got, tc.negotiated)
+		}
+		conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+		if err := conn.WriteJSON(map[string]string{"hello": "world"}); err != nil {
+			t.Fatal(err)
+		}
+		_, reply, err := conn.ReadMessage()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != tc.reply {
+			t.Errorf("requesting %s got reply %s, want %s", tc.requested, reply, tc.reply)
+		}
+	}
+}
+
+func TestOnDisconnectRunsOncePerConnection(t *testing.T) {
+	s := NewServer()
+	s.Handler = panicHandler{}
+	captureLogs(s)
+	var mu sync.Mutex
+	connected := make(map[string]int)
+	disconnected := make(map[string]int)
+	s.OnConnect = func(c *Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		connected[c.ID()]++
+	}
+	s.OnDisconnect = func(c *Conn, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		disconnected[c.ID()]++
+	}
+	h := startServer(t, s)
+	clean, dropped, panicking, open := h.Dial("/ws"), h.Dial("/ws"), h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 4)
+
+	clean.Close()
+	dropped.Conn.NetConn().Close()
+	panicking.SendJSON(map[string]bool{"panic": true})
+	waitForConns(t, s, 1)
+	// Closing the last client while shutdown closes it from the server
+	// side races the two paths against each other.
+	go open.Close()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitForConns(t, s, 0)
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(connected) != 4 || len(disconnected) != 4 {
+		t.Fatalf("OnConnect ran for %v and OnDisconnect for %v, want 4 connections each",
+			connected, disconnected)
+	}
+	for id, n := range disconnected {
+		if n != 1 || connected[id] != 1 {
+			t.Errorf("connection %s: OnConnect ran %d times, OnDisconnect %d times",
+				id, connected[id], n)
+		}
+	}
+}
+
+func TestIdleTimeoutIgnoresPongs(t *testing.T) {
+	s := NewServer()
+	s.IdleTimeout = 150 * time.Millisecond
+	s.PingInterval = 20 * time.Millisecond
+	c := startServer(t, s).Dial("/ws")
+
+	c.SendJSON(map[string]string{"hello": "world"})
+	c.ExpectJSON(`{"hello":"world","reply":"Message received"}`)
+	// Reading answers the server's pings, which must not count as activity.
+	start := time.Now()
+	c.ExpectClose(websocket.CloseNormalClosure)
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Fatalf("idle connection closed after %v, want about %v", d, s.IdleTimeout)
+	}
+}
+
+func TestMalformedJSONGetsErrorReply(t *testing.T) {
+	c := startServer(t, NewServer()).Dial("/ws")
+
+	c.Send([]byte(`{"hello":`))
+	var reply errorReply
+	c.ReceiveJSON(&reply)
+	if reply.Error != "invalid json" || reply.Detail == "" {
+		t.Fatalf("got %+v, want an invalid json reply with detail", reply)
+	}
+	c.SendJSON(map[string]string{"hello": "world"})
+	c.ExpectJSON(`{"hello":"world","reply":"Message received"}`)
+}
+
+func TestRepeatedMalformedJSONClosesConnection(t *testing.T) {
+	s := NewServer()
+	s.MaxDecodeFailures = 3
+	c := startServer(t, s).Dial("/ws")
+
+	// A good message resets the count, so only the last three are
+	// consecutive.
+	c.Send([]byte(`not json`))
+	c.Send([]byte(`{}`))
+	for i := 0; i < s.MaxDecodeFailures; i++ {
+		c.Send([]byte(`not json`))
+	}
+
+	// Every message but the one that reaches the threshold gets a reply.
+	replies := 0
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	for {
+		_, _, err := c.Conn.ReadMessage()
+		if err == nil {
+			replies++
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+			t.Fatalf("got %v, want close code %d", err, websocket.CloseUnsupportedData)
+		}
+		break
+	}
+	if want := 1 + s.MaxDecodeFailures; replies != want {
+		t.Fatalf("got %d replies before the close, want %d", replies, want)
+	}
+}
+
+func TestEchoKeepsRequestID(t *testing.T) {
+	c := startServer(t, NewServer()).Dial("/ws")
+
+	c.Send([]byte(`{"id":"42","op":"ping"}`))
+	c.ExpectJSON(`{"id":"42","op":"ping","reply":"Message received"}`)
+}
+
+// pongHandler answers every message with a fresh {"op":"pong"} reply.
+type pongHandler struct{}
+
+func (pongHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	var request Message
+	if err := json.Unmarshal(msg, &request); err != nil {
+		return nil, err
+	}
+	return json.Marshal(ReplyTo(request, Message{"op": json.RawMessage(`"pong"`)}))
+}
+
+func TestReplyToMatchesClientRequest(t *testing.T) {
+	s := NewServer()
+	s.Handler = pongHandler{}
+	h := startServer(t, s)
+	c, err := client.Dial(h.URL("/ws"), client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply, err := c.Request(ctx, map[string]string{"op": "ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct{ Op string }
+	if err := json.Unmarshal(reply, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Op != "pong" {
+		t.Fatalf("got reply %s, want the handler's pong", reply)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	s := NewServer()
+	s.MaxConnections = 2
+	h := startServer(t, s)
+	first := h.Dial("/ws")
+	h.Dial("/ws")
+	waitForConns(t, s, 2)
+
+	conn, resp, err := websocket.DefaultDialer.Dial(h.URL("/ws"), nil)
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("third connection got %s with Retry-After %q, want 503 with Retry-After",
+			resp.Status, resp.Header.Get("Retry-After"))
+	}
+
+	// Closing a connection frees its slot.
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for dialStatus(t, h.URL("/ws"), nil) != http.StatusSwitchingProtocols {
+		if time.Now().After(deadline) {
+			t.Fatal("slot of a closed connection was never freed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlowHandshakeIsAborted(t *testing.T) {
+	s := NewServer()
+	s.HandshakeTimeout = 100 * time.Millisecond
+	addr := serveOnFreePort(t, s, &http.Server{})
+
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var err error
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	// Send the request line and stall before the end of the headers.
+	start := time.Now()
+	if _, err := conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: " + addr + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("server did not abort the handshake: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("handshake aborted after %v, want about %v", d, s.HandshakeTimeout)
+	}
+}
+
+// expectCloseReason fails the test unless the server closes c with code
+// and reason.
+func expectCloseReason(t *testing.T, c *testutil.Client, code int, reason string) {
+	t.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	for {
+		_, _, err := c.Conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != code || closeErr.Text != reason {
+			t.Fatalf("got %v, want close %d %q", err, code, reason)
+		}
+		return
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	t.Run("shutdown", func(t *testing.T) {
+		s := NewServer()
+		c := startServer(t, s).Dial("/ws")
+		waitForConns(t, s, 1)
+		go s.Shutdown(context.Background())
+		expectCloseReason(t, c, websocket.CloseGoingAway, "server shutting down")
+	})
+	t.Run("rate limit", func(t *testing.T) {
+		s := NewServer()
+		s.RateLimit, s.RateBurst, s.RateLimitPolicy = 1, 1, RateLimitClose
+		c := startServer(t, s).Dial("/ws")
+		c.Send([]byte(`{}`))
+		c.Send([]byte(`{}`))
+		expectCloseReason(t, c, websocket.ClosePolicyViolation, "rate limit exceeded")
+	})
+	t.Run("read timeout", func(t *testing.T) {
+		s := NewServer()
+		s.ReadDeadline = 50 * time.Millisecond
+		c := startServer(t, s).Dial("/ws")
+		expectCloseReason(t, c, websocket.CloseGoingAway, "read timeout")
+	})
+	t.Run("idle timeout", func(t *testing.T) {
+		s := NewServer()
+		s.IdleTimeout = 50 * time.Millisecond
+		c := startServer(t, s).Dial("/ws")
+		expectCloseReason(t, c, websocket.CloseNormalClosure, "idle timeout")
+	})
+}
+
+// blockingHandler blocks until the connection's context is cancelled and
+// reports the cancellation on done.
+type blockingHandler struct {
+	started chan struct{}
+	done    chan error
+}
+
+func (h blockingHandler) Handle(ctx context.Context, msg []byte) ([]byte, error) {
+	close(h.started)
+	<-ctx.Done()
+	h.done <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestHandlerContextCancelledOnDisconnect(t *testing.T) {
+	s := NewServer()
+	handler := blockingHandler{started: make(chan struct{}), done: make(chan error, 1)}
+	s.Handler = handler
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{}`))
+	<-handler.started
+	c.Conn.NetConn().Close()
+	select {
+	case err := <-handler.done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("handler context ended with %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler context was not cancelled when the client went away")
+	}
+	waitForConns(t, s, 0)
+}
+
+func TestDrainForceClosesStragglers(t *testing.T) {
+	s := NewServer()
+	s.DrainNotice = []byte(`{"type":"server_draining"}`)
+	h := startServer(t, s)
+	s.Hub.Coalesce(time.Millisecond, 10)
+	polite, stubborn, subscribed := h.Dial("/ws"), h.Dial("/ws"), h.Dial("/ws")
+	waitForConns(t, s, 3)
+	sendControl(subscribed, map[string]any{"type": "subscribe", "events": []string{"price"}})
+
+	const wait = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- s.Drain(ctx) }()
+
+	polite.ExpectJSON(`{"type":"server_draining"}`)
+	stubborn.ExpectJSON(`{"type":"server_draining"}`)
+	// The notice bypasses subscriptions and coalescing.
+	subscribed.ExpectJSON(`{"type":"server_draining"}`)
+	if got := dialStatus(t, h.URL("/ws"), nil); got != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade during drain got %d, want 503", got)
+	}
+	polite.Close()
+	waitForConns(t, s, 2)
+
+	stubborn.ExpectClose(websocket.CloseGoingAway)
+	subscribed.ExpectClose(websocket.CloseGoingAway)
+	if d := time.Since(start); d < wait {
+		t.Fatalf("stubborn client closed after %v, before the drain deadline", d)
+	}
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCloseHandshakeEchoesCode(t *testing.T) {
+	for _, code := range []int{websocket.CloseNormalClosure, 4000} {
+		c := startServer(t, NewServer()).Dial("/ws")
+		msg := websocket.FormatCloseMessage(code, "bye")
+		if err := c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.Timeout)); err != nil {
+			t.Fatal(err)
+		}
+		c.ExpectClose(code)
+	}
+}
+
+func TestEchoPreservesTypedJSON(t *testing.T) {
+	c := startServer(t, NewServer()).Dial("/ws")
+
+	c.Send([]byte(`{"type":"chat","data":{"count":5}}`))
+	c.ExpectJSON(`{"type":"chat","data":{"count":5},"reply":"Message received"}`)
+
+	// A client's own "reply" field is echoed as sent.
+	c.Send([]byte(`{"reply":{"to":7}}`))
+	c.ExpectJSON(`{"reply":{"to":7}}`)
+}
+
+func TestEchoRejectsNonObjects(t *testing.T) {
+	c := startServer(t, NewServer()).Dial("/ws")
+
+	for _, msg := range []string{`null`, `[1,2]`, `5`} {
+		c.Send([]byte(msg))
+		var reply errorReply
+		c.ReceiveJSON(&reply)
+		if reply.Error != "invalid json" {
+			t.Fatalf("%s got %+v, want an invalid json reply", msg, reply)
+		}
+		// A valid message in between keeps the failure count at one.
+		c.Send([]byte(`{}`))
+		c.ExpectJSON(`{"reply":"Message received"}`)
+	}
+}
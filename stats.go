@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of one connection's traffic. Only data frames are
+// counted; pings, pongs and close frames are not.
+type ConnStats struct {
+	MessagesSent     uint64    `json:"messages_sent"`
+	MessagesReceived uint64    `json:"messages_received"`
+	BytesSent        uint64    `json:"bytes_sent"`
+	BytesReceived    uint64    `json:"bytes_received"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	LastActivity     time.Time `json:"last_activity"`
+	// Compressed reports whether the connection negotiated
+	// permessage-deflate.
+	Compressed bool `json:"compressed"`
+}
+
+// connStats holds the live counters behind ConnStats. The read loop and the
+// writer goroutine update it concurrently, so every field is atomic.
+type connStats struct {
+	connectedAt      time.Time
+	messagesSent     atomic.Uint64
+	messagesReceived atomic.Uint64
+	bytesSent        atomic.Uint64
+	bytesReceived    atomic.Uint64
+	// lastActivity is the UnixNano time of the last data frame in either
+	// direction.
+	lastActivity atomic.Int64
+}
+
+func newConnStats() *connStats {
+	now := time.Now()
+	s := &connStats{connectedAt: now}
+	s.lastActivity.Store(now.UnixNano())
+	return s
+}
+
+func (s *connStats) received(n int) {
+	s.messagesReceived.Add(1)
+	s.bytesReceived.Add(uint64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *connStats) sent(n int) {
+	s.messagesSent.Add(1)
+	s.bytesSent.Add(uint64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *connStats) snapshot() ConnStats {
+	return ConnStats{
+		MessagesSent:     s.messagesSent.Load(),
+		MessagesReceived: s.messagesReceived.Load(),
+		BytesSent:        s.bytesSent.Load(),
+		BytesReceived:    s.bytesReceived.Load(),
+		ConnectedAt:      s.connectedAt,
+		LastActivity:     time.Unix(0, s.lastActivity.Load()),
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnStatsCountTraffic(t *testing.T) {
+	s := NewServer()
+	start := time.Now()
+	c := startServer(t, s).Dial("/ws")
+
+	var in, out int
+	for _, msg := range []string{`{"n":1}`, `{"n":22}`, `{"n":333}`} {
+		c.Send([]byte(msg))
+		in += len(msg)
+		out += len(c.Receive())
+	}
+
+	// The writer counts a frame after writing it, which may be after the
+	// client has read it.
+	id := s.Hub.ConnIDs()[0]
+	var st ConnStats
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st = s.Hub.Stats()[id]
+		if st.MessagesSent == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	want := ConnStats{
+		MessagesSent:     3,
+		MessagesReceived: 3,
+		BytesSent:        uint64(out),
+		BytesReceived:    uint64(in),
+	}
+	got := st
+	got.ConnectedAt, got.LastActivity = time.Time{}, time.Time{}
+	if got != want {
+		t.Fatalf("got stats %+v, want %+v", got, want)
+	}
+	if st.ConnectedAt.Before(start) || st.LastActivity.Before(st.ConnectedAt) {
+		t.Fatalf("connected at %v and last active at %v, test started at %v",
+			st.ConnectedAt, st.LastActivity, start)
+	}
+}
+
+func TestStatsRecordCompression(t *testing.T) {
+	s := NewServer()
+	s.EnableCompression = true
+	h := startServer(t, s)
+	h.Dial("/ws")
+	waitForConns(t, s, 1)
+	plain := s.Hub.ConnIDs()[0]
+	h.Dialer = &websocket.Dialer{EnableCompression: true}
+	h.Dial("/ws")
+	waitForConns(t, s, 2)
+
+	for id, st := range s.Hub.Stats() {
+		if want := id != plain; st.Compressed != want {
+			t.Errorf("connection %s recorded compression %v, want %v", id, st.Compressed, want)
+		}
+	}
+	waitForMetric(t, s.Metrics, "websocket_connections_compressed_total 1")
+}
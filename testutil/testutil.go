@@ -0,0 +1,165 @@
+// Package testutil runs a WebSocket endpoint on an httptest.Server for
+// integration tests, without binding a fixed port. The server package is a
+// command and cannot be imported, so the harness takes any http.Handler:
+//
+//	func TestEcho(t *testing.T) {
+//		h := testutil.Start(t, NewServer().HTTPHandler())
+//		c := h.Dial("/ws")
+//		c.SendJSON(map[string]string{"hello": "world"})
+//		c.ExpectJSON(`{"hello":"world","reply":"Message received"}`)
+//	}
+//
+// Everything the harness creates is torn down on t.Cleanup.
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTimeout bounds every read and write a Client makes.
+const DefaultTimeout = 2 * time.Second
+
+// Harness is an httptest.Server serving the endpoint under test.
+type Harness struct {
+	t      testing.TB
+	Server *httptest.Server
+	// Dialer is used by Dial and DialHeader, e.g. to negotiate compression
+	// or a subprotocol. Nil means websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+}
+
+// Start serves h on a new httptest.Server, which is closed when the test
+// ends. Clients dialed through the harness are closed before it.
+func Start(t testing.TB, h http.Handler) *Harness {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return &Harness{t: t, Server: srv}
+}
+
+// URL returns the ws:// URL of path on the harness server.
+func (h *Harness) URL(path string) string {
+	return "ws" + strings.TrimPrefix(h.Server.URL, "http") + path
+}
+
+// Dial connects a client to path, failing the test if the upgrade fails.
+func (h *Harness) Dial(path string) *Client {
+	h.t.Helper()
+	return h.DialHeader(path, nil)
+}
+
+// DialHeader is like Dial but sends header with the upgrade request, e.g. an
+// Authorization or Origin header.
+func (h *Harness) DialHeader(path string, header http.Header) *Client {
+	h.t.Helper()
+	d := h.Dialer
+	if d == nil {
+		d = websocket.DefaultDialer
+	}
+	conn, _, err := d.Dial(h.URL(path), header)
+	if err != nil {
+		h.t.Fatalf("testutil: dialing %s: %v", path, err)
+	}
+	c := &Client{t: h.t, Conn: conn, Timeout: DefaultTimeout}
+	h.t.Cleanup(c.Close)
+	return c
+}
+
+// Client is a test connection whose helpers fail the test on error instead
+// of returning it.
+type Client struct {
+	t       testing.TB
+	Conn    *websocket.Conn
+	Timeout time.Duration
+}
+
+// Send writes msg as a text frame.
+func (c *Client) Send(msg []byte) {
+	c.t.Helper()
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if err := c.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		c.t.Fatalf("testutil: sending: %v", err)
+	}
+}
+
+// SendJSON writes v encoded as JSON in a text frame.
+func (c *Client) SendJSON(v any) {
+	c.t.Helper()
+	msg, err := json.Marshal(v)
+	if err != nil {
+		c.t.Fatalf("testutil: encoding: %v", err)
+	}
+	c.Send(msg)
+}
+
+// Receive returns the next data frame, failing the test if none arrives
+// within Timeout.
+func (c *Client) Receive() []byte {
+	c.t.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	_, msg, err := c.Conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("testutil: receiving: %v", err)
+	}
+	return msg
+}
+
+// ReceiveJSON decodes the next data frame into v.
+func (c *Client) ReceiveJSON(v any) {
+	c.t.Helper()
+	msg := c.Receive()
+	if err := json.Unmarshal(msg, v); err != nil {
+		c.t.Fatalf("testutil: decoding %s: %v", msg, err)
+	}
+}
+
+// ExpectJSON fails the test unless the next data frame is JSON equal to
+// want. Key order and whitespace do not matter.
+func (c *Client) ExpectJSON(want string) {
+	c.t.Helper()
+	var wantValue, gotValue any
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		c.t.Fatalf("testutil: decoding expected %s: %v", want, err)
+	}
+	got := c.Receive()
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		c.t.Fatalf("testutil: decoding %s: %v", got, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		c.t.Fatalf("testutil: got %s, want %s", got, want)
+	}
+}
+
+// ExpectClose fails the test unless the server closes the connection with
+// code before Timeout. Data frames still queued ahead of the close frame
+// are skipped.
+func (c *Client) ExpectClose(code int) {
+	c.t.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	for {
+		_, _, err := c.Conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			c.t.Fatalf("testutil: got %v, want close code %d", err, code)
+		}
+		return
+	}
+}
+
+// Close sends a normal close frame and closes the connection. It is safe
+// to call more than once; the harness calls it on cleanup.
+func (c *Client) Close() {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(c.Timeout))
+	c.Conn.Close()
+}
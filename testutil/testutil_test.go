@@ -0,0 +1,73 @@
+package testutil_test
+
+import (
+	"net/http"
+	"testing"
+
+	"Websocket/testutil"
+	"github.com/gorilla/websocket"
+)
+
+// echo echoes every frame until the client sends "bye", then closes with
+// CloseNormalClosure.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	for {
+		typ, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if string(msg) == `"bye"` {
+			ws.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+		if err := ws.WriteMessage(typ, msg); err != nil {
+			return
+		}
+	}
+})
+
+func TestEchoRoundTrip(t *testing.T) {
+	h := testutil.Start(t, echo)
+	c := h.Dial("/")
+
+	c.SendJSON(map[string]any{"hello": "world", "n": 1})
+	c.ExpectJSON(`{"n": 1, "hello": "world"}`)
+
+	c.Send([]byte(`{"nested":{"a":[1,2]}}`))
+	var got struct {
+		Nested struct{ A []int }
+	}
+	c.ReceiveJSON(&got)
+	if len(got.Nested.A) != 2 {
+		t.Fatalf("decoded %+v", got)
+	}
+
+	c.Send([]byte(`{"skipped":true}`))
+	c.SendJSON("bye")
+	c.ExpectClose(websocket.CloseNormalClosure)
+}
+
+func TestDialHeaderAndDialer(t *testing.T) {
+	h := testutil.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{Subprotocols: []string{"v1"}}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.WriteJSON(map[string]string{
+			"tenant":      r.Header.Get("X-Tenant"),
+			"subprotocol": ws.Subprotocol(),
+		})
+		ws.ReadMessage()
+	}))
+	h.Dialer = &websocket.Dialer{Subprotocols: []string{"v1"}}
+
+	c := h.DialHeader("/", http.Header{"X-Tenant": {"acme"}})
+	c.ExpectJSON(`{"tenant":"acme","subprotocol":"v1"}`)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// selfSignedCert writes a certificate for 127.0.0.1 and its key to dir and
+// returns their paths with a pool trusting the certificate.
+func selfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveOnFreePort runs s.ListenAndServe on a free loopback port until the
+// test ends and returns the address.
+func serveOnFreePort(t *testing.T, s *Server, hs *http.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Addr = l.Addr().String()
+	l.Close()
+	hs.Handler = s.HTTPHandler()
+	errc := make(chan error, 1)
+	go func() { errc <- s.ListenAndServe(hs) }()
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		hs.Close()
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	})
+	return hs.Addr
+}
+
+// dialRetry dials url until the server starts listening.
+func dialRetry(t *testing.T, d *websocket.Dialer, url string) *websocket.Conn {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, err := d.Dial(url, nil)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dialing %s: %v", url, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	s := NewServer()
+	var pool *x509.CertPool
+	s.CertFile, s.KeyFile, pool = selfSignedCert(t, t.TempDir())
+	s.TLSConfig = &tls.Config{MaxVersion: tls.VersionTLS12}
+	addr := serveOnFreePort(t, s, &http.Server{})
+
+	d := &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	conn := dialRetry(t, d, "wss://"+addr+"/ws")
+	if v := conn.NetConn().(*tls.Conn).ConnectionState().Version; v != tls.VersionTLS12 {
+		t.Errorf("negotiated TLS version %x, want TLS 1.2 from TLSConfig", v)
+	}
+	if err := conn.WriteJSON(map[string]string{"hello": "tls"}); err != nil {
+		t.Fatal(err)
+	}
+	var reply map[string]string
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply["hello"] != "tls" {
+		t.Fatalf("got %v over wss", reply)
+	}
+}
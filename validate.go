@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// errTypeRequired is returned by RequireType.
+var errTypeRequired = errors.New(`"type" must be a non-empty string`)
+
+// Validator checks the shape of an inbound JSON message before it reaches
+// the handler. Returning an error rejects the message with an
+// {"error":"invalid message"} reply; the connection stays open.
+type Validator func(msg json.RawMessage) error
+
+// RequireType is a Validator that accepts only JSON objects with a
+// non-empty string "type" field.
+func RequireType(msg json.RawMessage) error {
+	if eventType(msg) == "" {
+		return errTypeRequired
+	}
+	return nil
+}
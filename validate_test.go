@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRequireType(t *testing.T) {
+	for _, tc := range []struct {
+		msg string
+		ok  bool
+	}{
+		{`{"type":"price"}`, true},
+		{`{"type":""}`, false},
+		{`{"type":7}`, false},
+		{`{"kind":"price"}`, false},
+		{`["price"]`, false},
+	} {
+		if err := RequireType(json.RawMessage(tc.msg)); (err == nil) != tc.ok {
+			t.Errorf("RequireType(%s) = %v, want ok %v", tc.msg, err, tc.ok)
+		}
+	}
+}
+
+func TestValidationRejectsMessage(t *testing.T) {
+	s := NewServer()
+	s.Validate = RequireType
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{"type":"price"}`))
+	c.ExpectJSON(`{"type":"price","reply":"Message received"}`)
+	c.Send([]byte(`{"hello":"world"}`))
+	c.ExpectJSON(`{"error":"invalid message","detail":"\"type\" must be a non-empty string"}`)
+	// The connection stays open after a rejection.
+	c.Send([]byte(`{"type":"trade"}`))
+	c.ExpectJSON(`{"type":"trade","reply":"Message received"}`)
+}
+
+func TestCustomValidator(t *testing.T) {
+	s := NewServer()
+	s.Validate = func(msg json.RawMessage) error {
+		var v struct{ Qty int }
+		if err := json.Unmarshal(msg, &v); err != nil || v.Qty <= 0 {
+			return errors.New("qty must be positive")
+		}
+		return nil
+	}
+	c := startServer(t, s).Dial("/ws")
+
+	c.Send([]byte(`{"qty":0}`))
+	c.ExpectJSON(`{"error":"invalid message","detail":"qty must be positive"}`)
+	c.Send([]byte(`{"qty":3}`))
+	c.ExpectJSON(`{"qty":3,"reply":"Message received"}`)
+}
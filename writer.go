@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errWriterClosed   = errors.New("connection writer closed")
+	errSendBufferFull = errors.New("send buffer full")
+)
+
+// outbound is a frame queued for the writer goroutine.
+type outbound struct {
+	messageType int
+	data        []byte
+}
+
+type writerConfig struct {
+	writeWait time.Duration
+	// bufferSize is the capacity of the send queue. A connection whose
+	// queue stays full for sendTimeout is evicted.
+	bufferSize  int
+	sendTimeout time.Duration
+	// compressionThreshold is the smallest data frame that is compressed
+	// when the connection negotiated permessage-deflate.
+	compressionThreshold int
+	log                  *slog.Logger
+	metrics              *Metrics
+	stats                *connStats
+}
+
+// connWriter owns the write side of a connection. gorilla/websocket allows
+// only one concurrent writer, so every frame, data or control, is queued
+// with Send and written by a single goroutine.
+type connWriter struct {
+	writerConfig
+	ws        *websocket.Conn
+	send      chan outbound
+	done      chan struct{}
+	exited    chan struct{}
+	closeOnce sync.Once
+
+	// written counts completed writes so a stall can be told apart from a
+	// queue that is merely busy; stalled is set while an eviction check is
+	// pending.
+	written atomic.Uint64
+	stalled atomic.Bool
+
+	failMu  sync.Mutex
+	failure error
+}
+
+func newConnWriter(ws *websocket.Conn, cfg writerConfig) *connWriter {
+	w := &connWriter{
+		writerConfig: cfg,
+		ws:           ws,
+		send:         make(chan outbound, cfg.bufferSize),
+		done:         make(chan struct{}),
+		exited:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Send queues a frame for writing. It is safe for concurrent use and fails
+// once the writer has been closed or has stopped after a write error.
+func (w *connWriter) Send(messageType int, data []byte) error {
+	select {
+	case <-w.done:
+		return errWriterClosed
+	case <-w.exited:
+		return errWriterClosed
+	default:
+	}
+	select {
+	case w.send <- outbound{messageType: messageType, data: data}:
+		return nil
+	case <-w.done:
+		return errWriterClosed
+	case <-w.exited:
+		return errWriterClosed
+	}
+}
+
+// TrySend is like Send but never blocks the producer. When the send buffer
+// is full the frame is dropped with errSendBufferFull, and if the writer
+// makes no progress within sendTimeout the connection is evicted.
+func (w *connWriter) TrySend(messageType int, data []byte) error {
+	select {
+	case <-w.done:
+		return errWriterClosed
+	case <-w.exited:
+		return errWriterClosed
+	default:
+	}
+	select {
+	case w.send <- outbound{messageType: messageType, data: data}:
+		return nil
+	default:
+		w.watchStall()
+		return errSendBufferFull
+	}
+}
+
+// watchStall arms the eviction check the first time the queue is found
+// full. The check repeats every sendTimeout while the queue stays full, and
+// the connection is closed once a whole interval passes without a frame
+// being written.
+func (w *connWriter) watchStall() {
+	if !w.stalled.CompareAndSwap(false, true) {
+		return
+	}
+	w.checkStall(w.written.Load())
+}
+
+func (w *connWriter) checkStall(mark uint64) {
+	time.AfterFunc(w.sendTimeout, func() {
+		select {
+		case <-w.exited:
+			w.stalled.Store(false)
+			return
+		default:
+		}
+		if len(w.send) < cap(w.send) {
+			w.stalled.Store(false)
+			return
+		}
+		if n := w.written.Load(); n != mark {
+			w.checkStall(n)
+			return
+		}
+		w.stalled.Store(false)
+		w.log.Warn("send buffer stayed full, dropping client",
+			"event", "backpressure", "timeout", w.sendTimeout)
+		w.metrics.error("backpressure")
+		w.fail(errSendBufferFull)
+	})
+}
+
+// fail tears the connection down after a failed or stalled write, so the
+// read loop stops too, and records err as the reason.
+func (w *connWriter) fail(err error) {
+	w.failMu.Lock()
+	if w.failure == nil {
+		w.failure = err
+	}
+	w.failMu.Unlock()
+	w.ws.Close()
+}
+
+// Err returns the error that made the writer tear the connection down, or
+// nil if it has not.
+func (w *connWriter) Err() error {
+	w.failMu.Lock()
+	defer w.failMu.Unlock()
+	return w.failure
+}
+
+// Close stops the writer after flushing frames that are already queued and
+// waits for the writer goroutine to exit.
+func (w *connWriter) Close() {
+	w.closeOnce.Do(func() { close(w.done) })
+	<-w.exited
+}
+
+func (w *connWriter) run() {
+	defer close(w.exited)
+	for {
+		select {
+		case m := <-w.send:
+			if !w.write(m) {
+				return
+			}
+		case <-w.done:
+			for {
+				select {
+				case m := <-w.send:
+					if !w.write(m) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a single frame and reports whether the writer may continue.
+// Nothing can follow a close frame, and any write error tears the
+// connection down so the read loop notices too.
+func (w *connWriter) write(m outbound) bool {
+	var err error
+	switch m.messageType {
+	case websocket.PingMessage, websocket.PongMessage, websocket.CloseMessage:
+		err = w.ws.WriteControl(m.messageType, m.data, deadline(w.writeWait))
+	default:
+		w.ws.EnableWriteCompression(len(m.data) >= w.compressionThreshold)
+		w.ws.SetWriteDeadline(deadline(w.writeWait))
+		err = w.ws.WriteMessage(m.messageType, m.data)
+	}
+	switch {
+	case errors.Is(err, websocket.ErrCloseSent):
+		return false
+	case isTimeout(err):
+		w.log.Info("write deadline exceeded, closing connection",
+			"event", "write_timeout", "err", err)
+		w.metrics.error("write_timeout")
+		w.fail(err)
+		return false
+	case err != nil:
+		w.log.Error("write failed", "event", "write_error", "err", err)
+		w.metrics.error("write_error")
+		w.fail(err)
+		return false
+	}
+	w.written.Add(1)
+	switch m.messageType {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		w.metrics.MessagesSent.Inc()
+		w.stats.sent(len(m.data))
+	case websocket.CloseMessage:
+		return false
+	}
+	return true
+}
+
+// keepalive pings the peer every interval until the writer stops.
+func (w *connWriter) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Send(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-w.done:
+			return
+		case <-w.exited:
+			return
+		}
+	}
+}
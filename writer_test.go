@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Websocket/testutil"
+	"github.com/gorilla/websocket"
+)
+
+// newTestWriter upgrades a connection on a test server and returns a
+// connWriter for its server side together with the client. Unset parts of
+// cfg get working defaults.
+func newTestWriter(t testing.TB, cfg writerConfig) (*connWriter, *testutil.Client) {
+	t.Helper()
+	return newTestWriterDialer(t, cfg, nil)
+}
+
+// newTestWriterDialer is like newTestWriter but dials with d, which may
+// negotiate compression.
+func newTestWriterDialer(t testing.TB, cfg writerConfig, d *websocket.Dialer) (*connWriter, *testutil.Client) {
+	t.Helper()
+	if cfg.bufferSize == 0 {
+		cfg.bufferSize = 16
+	}
+	if cfg.log == nil {
+		cfg.log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if cfg.metrics == nil {
+		cfg.metrics = NewMetrics()
+	}
+	if cfg.stats == nil {
+		cfg.stats = newConnStats()
+	}
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	conns := make(chan *websocket.Conn, 1)
+	h := testutil.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- ws
+	}))
+	h.Dialer = d
+	c := h.Dial("/")
+	w := newConnWriter(<-conns, cfg)
+	t.Cleanup(func() {
+		// Closing the socket first unblocks a writer stuck on a client
+		// that stopped reading.
+		w.ws.Close()
+		w.Close()
+	})
+	return w, c
+}
+
+func TestConcurrentSend(t *testing.T) {
+	const n = 1000
+	w, c := newTestWriter(t, writerConfig{writeWait: time.Second})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := w.Send(websocket.TextMessage, []byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+				t.Error(err)
+			}
+			if i%10 == 0 {
+				if err := w.Send(websocket.PingMessage, nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+
+	seen := make(map[int]bool)
+	for len(seen) < n {
+		var msg struct{ N int }
+		if err := json.Unmarshal(c.Receive(), &msg); err != nil {
+			t.Fatalf("corrupted frame: %v", err)
+		}
+		if seen[msg.N] {
+			t.Fatalf("frame %d received twice", msg.N)
+		}
+		seen[msg.N] = true
+	}
+	wg.Wait()
+}
+
+func TestStalledWriterIsEvicted(t *testing.T) {
+	w, c := newTestWriter(t, writerConfig{
+		bufferSize:  4,
+		sendTimeout: 200 * time.Millisecond,
+	})
+	frame := bytes.Repeat([]byte("x"), 64<<10)
+
+	// A blocking producer keeps the queue full until the writer is stuck
+	// on a client that does not read.
+	go func() {
+		for w.Send(websocket.TextMessage, frame) == nil {
+		}
+	}()
+	for last := uint64(1 << 63); ; {
+		time.Sleep(50 * time.Millisecond)
+		n := w.written.Load()
+		if n == last && len(w.send) == cap(w.send) {
+			break
+		}
+		last = n
+	}
+
+	// Arm the eviction check, then let the writer make some progress
+	// before the check fires. The queue refills and stays full.
+	if err := w.TrySend(websocket.TextMessage, frame); !errors.Is(err, errSendBufferFull) {
+		t.Fatalf("TrySend on a full queue returned %v", err)
+	}
+	mark := w.written.Load()
+	for w.written.Load() == mark {
+		c.Receive()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !errors.Is(w.Err(), errSendBufferFull) {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer with a full queue was not evicted, err %v", w.Err())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// frameTap records what the client reads off the wire, so tests can look
+// at frame headers gorilla does not expose.
+type frameTap struct {
+	net.Conn
+	mu   sync.Mutex
+	read []byte
+}
+
+func (c *frameTap) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.read = append(c.read, p[:n]...)
+	c.mu.Unlock()
+	return n, err
+}
+
+// next returns the bytes read since the last call.
+func (c *frameTap) next() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.read
+	c.read = nil
+	return b
+}
+
+// compressingDialer negotiates permessage-deflate and records the frames
+// read on the connection it dials in tap.
+func compressingDialer(tap *frameTap) *websocket.Dialer {
+	return &websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			tap.Conn = conn
+			return tap, err
+		},
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	tap := &frameTap{}
+	w, c := newTestWriterDialer(t, writerConfig{
+		writeWait:            time.Second,
+		compressionThreshold: 256,
+	}, compressingDialer(tap))
+	tap.next() // the handshake response
+
+	const rsv1 = 0x40 // set on the first frame of a compressed message
+	for _, tc := range []struct {
+		size       int
+		compressed bool
+	}{
+		{255, false},
+		{256, true},
+		{64 << 10, true},
+	} {
+		msg := bytes.Repeat([]byte("a"), tc.size)
+		if err := w.Send(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Receive(); !bytes.Equal(got, msg) {
+			t.Fatalf("%d byte frame came back as %d bytes", tc.size, len(got))
+		}
+		wire := tap.next()
+		if got := wire[0]&rsv1 != 0; got != tc.compressed {
+			t.Errorf("%d byte frame compressed %v, want %v", tc.size, got, tc.compressed)
+		}
+	}
+}
+
+func BenchmarkSmallFrames(b *testing.B) {
+	msg := []byte(`{"type":"price","symbol":"ABC","bid":101.25,"ask":101.5}`)
+	for _, bc := range []struct {
+		name      string
+		threshold int
+	}{
+		{"compress-all", 0},
+		{"threshold", 256},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			w, c := newTestWriterDialer(b, writerConfig{
+				writeWait:            time.Second,
+				bufferSize:           256,
+				compressionThreshold: bc.threshold,
+			}, &websocket.Dialer{EnableCompression: true})
+			go func() {
+				for {
+					if _, _, err := c.Conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.Send(websocket.TextMessage, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for w.written.Load() < uint64(b.N) {
+				runtime.Gosched()
+			}
+		})
+	}
+}
+
+func TestWriteTimeoutClosesConnection(t *testing.T) {
+	s := NewServer()
+	s.WriteDeadline = 100 * time.Millisecond
+	s.SendTimeout = time.Minute // leave eviction to the write deadline
+	causes := make(chan error, 1)
+	s.OnDisconnect = func(c *Conn, err error) { causes <- err }
+	h := startServer(t, s)
+	h.Dial("/ws") // never reads
+	waitForConns(t, s, 1)
+
+	payload := []byte(`"` + strings.Repeat("x", 256<<10) + `"`)
+	timeout := time.After(2 * time.Second)
+	for {
+		s.Hub.Broadcast(payload)
+		select {
+		case err := <-causes:
+			if !isTimeout(err) {
+				t.Fatalf("disconnect cause %v, want a write timeout", err)
+			}
+			waitForConns(t, s, 0)
+			return
+		case <-timeout:
+			t.Fatal("connection that stopped reading was never closed")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}